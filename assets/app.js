@@ -0,0 +1,20 @@
+// Copies the value of the input inside any element with data-copy when it is
+// clicked. Bound here rather than inline so the pages need no unsafe-inline.
+document.addEventListener('click', function (event) {
+  const target = event.target.closest('[data-copy]');
+  if (!target) {
+    return;
+  }
+
+  event.preventDefault();
+  event.stopPropagation();
+
+  const input = target.querySelector('input');
+  input.focus();
+  input.select();
+  if (navigator.clipboard) {
+    navigator.clipboard.writeText(input.value);
+  } else {
+    document.execCommand('copy');
+  }
+});
@@ -0,0 +1,137 @@
+// Package assets embeds the static files of the site. They are served under
+// names containing a hash of their content, so they can be cached forever and
+// a new release never serves stale ones.
+package assets
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// Everything is embedded as main.css is built by tailwind rather than
+// committed. htmx.min.js is vendored with `just htmx`.
+//
+//go:embed *
+var embedded embed.FS
+
+// Asset is a static file.
+type Asset struct {
+	Name      string // As committed, e.g. app.js
+	Path      string // URL path it's served on, e.g. /static/app.1a2b3c4d.js
+	Integrity string // Subresource Integrity hash, empty in development
+}
+
+// Manifest maps the names of the static files to their assets.
+type Manifest struct {
+	FS     fs.FS
+	Assets map[string]Asset
+	hashed map[string]string // Hashed name to name
+	dev    bool
+}
+
+var current atomic.Pointer[Manifest]
+
+func init() {
+	manifest, err := newManifest(embedded)
+	if err != nil {
+		panic(err)
+	}
+	current.Store(manifest)
+}
+
+// Current returns the manifest of the files being served.
+func Current() *Manifest {
+	return current.Load()
+}
+
+// UseDir serves the files in dir instead of the embedded ones. They are read
+// on every request under their own names, so edits show up without a restart.
+func UseDir(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	current.Store(&Manifest{FS: os.DirFS(dir), dev: true})
+
+	return nil
+}
+
+// Dev reports whether the files are served from disk.
+func (m *Manifest) Dev() bool {
+	return m.dev
+}
+
+// Lookup returns the name of the file served as requested, whether the name
+// was hashed so it's safe to cache forever, and whether there is such a file.
+// Files from disk are only served under their own names.
+func (m *Manifest) Lookup(requested string) (name string, immutable, ok bool) {
+	if m.dev {
+		return requested, false, true
+	}
+	if name, ok := m.hashed[requested]; ok {
+		return name, true, true
+	}
+	_, ok = m.Assets[requested]
+
+	return requested, false, ok
+}
+
+// Path returns the URL path of a static file. Unknown files are served under
+// their own name.
+func Path(name string) string {
+	if asset, ok := Current().Assets[name]; ok {
+		return asset.Path
+	}
+
+	return "/static/" + name
+}
+
+// Integrity returns the Subresource Integrity hash of a static file, or an
+// empty string if it's unknown or served from disk.
+func Integrity(name string) string {
+	return Current().Assets[name].Integrity
+}
+
+func newManifest(fsys fs.FS) (*Manifest, error) {
+	m := &Manifest{FS: fsys, Assets: map[string]Asset{}, hashed: map[string]string{}}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(name) == ".go" {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		hashed := hashedName(name, hex.EncodeToString(sum[:4]))
+		integrity := sha512.Sum384(data)
+		m.Assets[name] = Asset{
+			Name:      name,
+			Path:      "/static/" + hashed,
+			Integrity: "sha384-" + base64.StdEncoding.EncodeToString(integrity[:]),
+		}
+		m.hashed[hashed] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// hashedName inserts hash before the extension of name.
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
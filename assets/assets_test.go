@@ -0,0 +1,98 @@
+package assets
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+// TestVendored checks the vendored scripts are the published releases pinned
+// in the justfile.
+func TestVendored(t *testing.T) {
+	for name, want := range map[string]string{
+		"htmx.min.js": "sha384-HGfztofotfshcF7+8n44JQL2oJmowVChPTg48S+jvZoztPfvwD79OC/LTtG6dMp+", // 2.0.4
+	} {
+		if got := Integrity(name); got != want {
+			t.Errorf("Integrity(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHashedName(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"app.js", "app.6e11c72f.js"},
+		{"htmx.min.js", "htmx.min.6e11c72f.js"},
+		{"fonts/inter.woff2", "fonts/inter.6e11c72f.woff2"},
+		{"LICENSE", "LICENSE.6e11c72f"},
+	} {
+		if got := hashedName(tt.name, "6e11c72f"); got != tt.want {
+			t.Errorf("hashedName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	m, err := newManifest(fstest.MapFS{
+		"app.js":            {Data: []byte("alert(1)")},
+		"fonts/inter.woff2": {Data: []byte("alert(1)")},
+		"assets.go":         {Data: []byte("package assets")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Asset{
+		Name:      "app.js",
+		Path:      "/static/app.6e11c72f.js",
+		Integrity: "sha384-HT2E9NfWiuQ/w1PRai+hTyqW16NIoCGA/m8VQDUopfAtcz6YQjtsMmQd5uRbVDpW",
+	}
+	if got := m.Assets["app.js"]; got != want {
+		t.Errorf("app.js = %+v, want %+v", got, want)
+	}
+	if got := m.Assets["fonts/inter.woff2"].Path; got != "/static/fonts/inter.6e11c72f.woff2" {
+		t.Errorf("fonts/inter.woff2 is served on %q, want it hashed in its directory", got)
+	}
+	if _, ok := m.Assets["assets.go"]; ok {
+		t.Error("the source of the package is served")
+	}
+
+	for _, tt := range []struct {
+		requested string
+		name      string
+		immutable bool
+		ok        bool
+	}{
+		{"app.6e11c72f.js", "app.js", true, true},
+		{"app.js", "app.js", false, true},
+		{"app.00000000.js", "app.00000000.js", false, false},
+		{"assets.go", "assets.go", false, false},
+	} {
+		name, immutable, ok := m.Lookup(tt.requested)
+		if name != tt.name || immutable != tt.immutable || ok != tt.ok {
+			t.Errorf("Lookup(%q) = %q, %v, %v, want %q, %v, %v", tt.requested, name, immutable, ok, tt.name, tt.immutable, tt.ok)
+		}
+	}
+}
+
+func TestUseDir(t *testing.T) {
+	previous := Current()
+	t.Cleanup(func() { current.Store(previous) })
+
+	if err := UseDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !Current().Dev() {
+		t.Error("files from disk aren't served in development mode")
+	}
+	if got := Path("app.js"); got != "/static/app.js" {
+		t.Errorf("Path(app.js) = %q, want the unhashed name", got)
+	}
+	if got := Integrity("app.js"); got != "" {
+		t.Errorf("Integrity(app.js) = %q, want none as the file may change", got)
+	}
+	if name, immutable, ok := Current().Lookup("app.js"); name != "app.js" || immutable || !ok {
+		t.Errorf("Lookup(app.js) = %q, %v, %v, want it served but not cached forever", name, immutable, ok)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/archive"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/rs/zerolog"
+)
+
+func exportCommand(flags *flag.FlagSet) runFunc {
+	out := flags.String("out", "-", "Archive to write, - for stdout")
+
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		db, err := openDB(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		var w io.Writer = os.Stdout
+		if *out == "-" {
+			// Keep the logs out of the archive.
+			log = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+		} else {
+			f, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		report, err := archive.Export(ctx, db, w)
+		if err != nil {
+			return err
+		}
+
+		log.Info().Int("users", report.Users).Int("histories", report.Histories).Int("aliases", report.Aliases).Int("blobs", report.Blobs).Msg("export complete")
+		return nil
+	}
+}
+
+func importCommand(flags *flag.FlagSet) runFunc {
+	in := flags.String("in", "-", "Archive to read, - for stdin")
+
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		db, err := openDB(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		var r io.Reader = os.Stdin
+		if *in != "-" {
+			f, err := os.Open(*in)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		report, err := archive.Import(ctx, db, r, int64(cfg.Download.MaxSize))
+		log.Info().Int("users", report.Users).Int("histories", report.Histories).Int("aliases", report.Aliases).Int("blobs", report.Blobs).Msg("import finished")
+
+		return err
+	}
+}
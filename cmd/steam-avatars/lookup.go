@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/download"
+	"github.com/mrmarble/steam-avatars/internal/imagemeta"
+	"github.com/mrmarble/steam-avatars/internal/server"
+	"github.com/mrmarble/steam-avatars/internal/steam"
+	"github.com/rs/zerolog"
+	"github.com/valkey-io/valkey-go"
+)
+
+type lookupResult struct {
+	SteamID     string       `json:"steam_id"`
+	PersonaName string       `json:"persona_name"`
+	VanityURL   string       `json:"vanity_url"`
+	Cached      bool         `json:"cached"`
+	CacheAge    string       `json:"cache_age,omitempty"`
+	Avatar      *lookupAsset `json:"avatar"`
+	Frame       *lookupAsset `json:"frame"`
+}
+
+type lookupAsset struct {
+	ItemID string          `json:"item_id,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	URL    string          `json:"url"`
+	Hash   string          `json:"hash"`
+	Meta   *imagemeta.Meta `json:"meta,omitempty"`
+	Path   string          `json:"path,omitempty"` // Where it was downloaded to
+}
+
+func lookupCommand(flags *flag.FlagSet) runFunc {
+	asJSON := flags.Bool("json", false, "Print the result as JSON")
+	noCache := flags.Bool("no-cache", false, "Fetch the user from Steam even if it is cached")
+	downloadDir := flags.String("download", "", "Directory the avatar and frame are saved to")
+
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		if len(args) != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		query := steam.NormalizeQuery(args[0])
+		client := steam.NewClient(cfg.Steam)
+		downloader := download.New(cfg.Download)
+
+		var (
+			user   *database.User
+			cached bool
+			age    time.Duration
+			err    error
+		)
+		if *noCache || cfg.Valkey.Endpoint == "" {
+			if cfg.Steam.APIKey == "" {
+				return errSteamAPIKey
+			}
+			user, err = server.SearchUser(ctx, client, downloader, query)
+		} else {
+			var db *database.Database
+			if db, err = openDB(cfg); err != nil {
+				return err
+			}
+			defer db.Close()
+
+			if cfg.Steam.APIKey == "" {
+				// Without a key only stored users can be shown.
+				user, err = server.LookupUser(ctx, db, query)
+				if valkey.IsValkeyNil(err) {
+					err = errSteamAPIKey
+				}
+				cached = err == nil
+			} else {
+				user, cached, err = server.FindUser(ctx, db, client, downloader, query)
+			}
+			if err == nil && cached {
+				age, err = db.UserAge(ctx, user.ID)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		result := &lookupResult{
+			SteamID:     strconv.FormatInt(user.ID, 10),
+			PersonaName: user.DisplayName,
+			VanityURL:   user.VanityURL,
+			Cached:      cached,
+			Avatar:      &lookupAsset{ItemID: user.AvatarItemID, Name: user.AvatarName, URL: user.AvatarURL, Hash: user.AvatarHash, Meta: user.AvatarMeta},
+		}
+		if cached {
+			result.CacheAge = age.Round(time.Second).String()
+		}
+		if user.FrameHash != "" {
+			result.Frame = &lookupAsset{ItemID: user.FrameItemID, Name: user.FrameName, URL: user.FrameURL, Hash: user.FrameHash, Meta: user.FrameMeta}
+		}
+
+		if *downloadDir != "" {
+			if err := os.MkdirAll(*downloadDir, 0o755); err != nil {
+				return err
+			}
+			if result.Avatar.Path, err = saveDataURI(*downloadDir, result.SteamID+"_avatar", user.Avatar); err != nil {
+				return fmt.Errorf("failed to save avatar: %w", err)
+			}
+			if result.Frame != nil {
+				if result.Frame.Path, err = saveDataURI(*downloadDir, result.SteamID+"_frame", user.Frame); err != nil {
+					return fmt.Errorf("failed to save frame: %w", err)
+				}
+			}
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(result)
+		}
+
+		return printLookup(result)
+	}
+}
+
+func printLookup(result *lookupResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	cache := "live"
+	if result.Cached {
+		cache = "cached " + result.CacheAge + " ago"
+	}
+
+	fmt.Fprintf(w, "SteamID\t%s\n", result.SteamID)
+	fmt.Fprintf(w, "Persona name\t%s\n", result.PersonaName)
+	fmt.Fprintf(w, "Vanity URL\t%s\n", result.VanityURL)
+	fmt.Fprintf(w, "Cache\t%s\n", cache)
+	for _, row := range []struct {
+		label string
+		asset *lookupAsset
+	}{{"Avatar", result.Avatar}, {"Frame", result.Frame}} {
+		if row.asset == nil {
+			fmt.Fprintf(w, "%s\tnone\n", row.label)
+			continue
+		}
+		item := "profile picture"
+		if row.asset.ItemID != "" {
+			item = fmt.Sprintf("%s (%s)", row.asset.Name, row.asset.ItemID)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", row.label, item)
+		fmt.Fprintf(w, "\tURL\t%s\n", row.asset.URL)
+		fmt.Fprintf(w, "\tSHA-256\t%s\n", row.asset.Hash)
+		if meta := row.asset.Meta; meta != nil {
+			fmt.Fprintf(w, "\tFormat\t%s %dx%d", meta.Format, meta.Width, meta.Height)
+			if meta.Animated {
+				fmt.Fprintf(w, ", %d frames, %s", meta.Frames, meta.Duration())
+			}
+			fmt.Fprintln(w)
+		}
+		if row.asset.Path != "" {
+			fmt.Fprintf(w, "\tSaved to\t%s\n", row.asset.Path)
+		}
+	}
+
+	return w.Flush()
+}
+
+// saveDataURI writes the content of a data URI to dir/name with the extension
+// of its MIME type, and returns the path.
+func saveDataURI(dir, name, uri string) (string, error) {
+	mime, data, err := database.DecodeDataURI(uri)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name+database.FileExtension(mime))
+
+	return path, os.WriteFile(path, data, 0o644)
+}
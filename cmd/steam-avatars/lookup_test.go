@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveDataURI(t *testing.T) {
+	content := []byte("image")
+	encoded := base64.StdEncoding.EncodeToString(content)
+
+	for _, tt := range []struct {
+		mime string
+		want string
+	}{
+		{"image/png", "76561197960287930_avatar.png"},
+		{"image/apng", "76561197960287930_avatar.png"},
+		{"image/jpeg", "76561197960287930_avatar.jpg"},
+		{"image/gif", "76561197960287930_avatar.gif"},
+		{"image/webp", "76561197960287930_avatar.webp"},
+		{"application/octet-stream", "76561197960287930_avatar"},
+	} {
+		t.Run(tt.mime, func(t *testing.T) {
+			dir := t.TempDir()
+
+			path, err := saveDataURI(dir, "76561197960287930_avatar", "data:"+tt.mime+";base64,"+encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, tt.want); path != want {
+				t.Errorf("path = %q, want %q", path, want)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != string(content) {
+				t.Errorf("saved %q (%v), want the decoded image", data, err)
+			}
+		})
+	}
+}
+
+func TestSaveDataURIInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := saveDataURI(dir, "76561197960287930_avatar", "https://avatars.steamstatic.com/avatar.jpg"); err == nil {
+		t.Error("saveDataURI() accepted a URL")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("saveDataURI() wrote %d files for an invalid URI", len(entries))
+	}
+}
@@ -2,61 +2,224 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/mrmarble/steam-avatars/internal/config"
 	"github.com/mrmarble/steam-avatars/internal/database"
 	"github.com/mrmarble/steam-avatars/internal/server"
+	"github.com/mrmarble/steam-avatars/internal/tracing"
 	"github.com/rs/zerolog"
 )
 
-func main() {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+type runFunc func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	needs   config.Requirement
+	// setup registers the flags of the command and returns its entry point.
+	setup func(flags *flag.FlagSet) runFunc
+}
+
+var commands []command
+
+func init() {
+	// Declared here as the help command lists them.
+	commands = []command{
+		{name: "serve", summary: "Run the web server (default)", needs: config.NeedValkey | config.NeedSteam, setup: serveCommand},
+		{name: "lookup", usage: "<id|vanity|url>", summary: "Show what is known about a user", setup: lookupCommand},
+		{name: "render", usage: "<id|vanity|url>...", summary: "Render avatars to files", setup: renderCommand},
+		{name: "warm", summary: "Fetch and store a list of users", needs: config.NeedValkey | config.NeedSteam, setup: warmCommand},
+		{name: "export", summary: "Export the store to an archive", needs: config.NeedValkey, setup: exportCommand},
+		{name: "import", summary: "Import an archive into the store", needs: config.NeedValkey, setup: importCommand},
+		{name: "migrate", summary: "Upgrade the stored records", needs: config.NeedValkey, setup: migrateCommand},
+		{name: "token", usage: "create <name> | list | revoke <id>", summary: "Manage the API tokens", needs: config.NeedValkey, setup: tokenCommand},
+		{name: "config", usage: "print", summary: "Print the configuration with secrets redacted", setup: configCommand},
+		{name: "version", summary: "Print the version", setup: versionCommand},
+		{name: "help", summary: "List the commands", setup: helpCommand},
+	}
+}
 
+func main() {
 	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
 	log := zerolog.New(output).With().Timestamp().Logger()
 
-	valkeyEndpoint := os.Getenv("VALKEY_ENDPOINT")
-	if valkeyEndpoint == "" {
-		log.Fatal().Msg("VALKEY_ENDPOINT is required")
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printCommands()
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: steam-avatars %s [flags] %s\n\n%s\n\nFlags:\n", cmd.name, cmd.usage, cmd.summary)
+		flags.PrintDefaults()
+	}
+	run := cmd.setup(flags)
+	loader := config.NewLoader(flags)
+	args = parseInterspersed(flags, args)
+
+	cfg, err := loader.Load()
+	err = errors.Join(err, cfg.Validate(cmd.needs))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n  %s\n", strings.ReplaceAll(err.Error(), "\n", "\n  "))
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing.Endpoint, version, cfg.Tracing.SampleRatio)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up tracing")
+	}
+
+	err = run(ctx, log, cfg, args)
+
+	// Flush the spans of the command before exiting.
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Error().Err(err).Msg("failed to flush traces")
 	}
 
-	db, err := database.OpenDB(valkeyEndpoint)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to open database")
+		log.Fatal().Err(err).Msg(name + " failed")
 	}
+}
 
-	steamAPIKey := flag.String("key", "", "Steam API key")
-	flag.Parse()
+func serveCommand(flags *flag.FlagSet) runFunc {
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		db, err := openDB(cfg)
+		if err != nil {
+			return err
+		}
 
-	if *steamAPIKey == "" {
-		if key, ok := os.LookupEnv("STEAM_API_KEY"); ok {
-			*steamAPIKey = key
-		} else {
-			log.Fatal().Msg("Steam API key is required")
+		server, err := server.NewServer(log, db, cfg)
+		if err != nil {
+			db.Close()
+			return err
 		}
+
+		// Start server
+		go func() {
+			if err := server.Start(); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Msg("shutting down the server")
+			}
+		}()
+
+		// Wait for interrupt signal to gracefully shutdown the server with a timeout
+		// of 10 seconds once the drain delay is over.
+		<-ctx.Done()
+		log.Info().Dur("drain", cfg.Server.DrainDelay).Msg("draining the server")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.DrainDelay+10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			return fmt.Errorf("shutting down the server: %w", err)
+		}
+		db.Close()
+
+		return nil
 	}
+}
 
-	server := server.NewServer(log, db, *steamAPIKey)
+func configCommand(flags *flag.FlagSet) runFunc {
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		if len(args) != 1 || args[0] != "print" {
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		fmt.Println(cfg.String())
+		return nil
+	}
+}
 
-	// Start server
-	go func() {
-		if err := server.Start(); err != nil && err != http.ErrServerClosed {
-			log.Fatal().Msg("shutting down the server")
+func versionCommand(flags *flag.FlagSet) runFunc {
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		revision := "unknown"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					revision = setting.Value
+				}
+			}
 		}
-	}()
 
-	// Wait for interrupt signal to gracefully shutdown the server with a timeout of 10 seconds.
-	<-ctx.Done()
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal().Err(err).Msg("shutting down the server")
+		fmt.Printf("steam-avatars %s (%s)\n", version, revision)
+		return nil
+	}
+}
+
+func helpCommand(flags *flag.FlagSet) runFunc {
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		printCommands()
+		return nil
+	}
+}
+
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "Usage: steam-avatars <command> [flags]\n\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun steam-avatars <command> -h for the flags of a command.")
+}
+
+// parseInterspersed parses flags that may appear before, between or after the
+// positional arguments, and returns the positional arguments. Everything after
+// "--" is positional.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		rest := flags.Args()
+		// The flag package drops the "--" that stopped it.
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
 	}
-	db.Close()
+}
 
+func openDB(cfg *config.Config) (*database.Database, error) {
+	db, err := database.OpenDB(cfg.Valkey.Endpoint, cfg.Valkey.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db.SetHistoryLimits(cfg.History.MaxEntries, cfg.History.Retention)
+
+	return db, nil
 }
+
+// errSteamAPIKey is returned by commands that only need the Steam API when
+// the data isn't available locally.
+var errSteamAPIKey = errors.New("steam.api_key (STEAM_API_KEY) is required to fetch users")
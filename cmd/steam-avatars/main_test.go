@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"slices"
+	"testing"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/rs/zerolog"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	for _, tt := range []struct {
+		args       []string
+		positional []string
+		out        string
+		json       bool
+	}{
+		{[]string{"gabe", "robin"}, []string{"gabe", "robin"}, "", false},
+		{[]string{"-out", "dir", "gabe"}, []string{"gabe"}, "dir", false},
+		{[]string{"gabe", "-json", "robin", "-out=dir"}, []string{"gabe", "robin"}, "dir", true},
+		{[]string{"-json", "--", "-out", "gabe"}, []string{"-out", "gabe"}, "", true},
+		{[]string{"gabe", "--", "-json", "--"}, []string{"gabe", "-json", "--"}, "", false},
+		{[]string{"gabe", "--"}, []string{"gabe"}, "", false},
+	} {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		out := flags.String("out", "", "")
+		asJSON := flags.Bool("json", false, "")
+
+		positional := parseInterspersed(flags, tt.args)
+		if !slices.Equal(positional, tt.positional) || *out != tt.out || *asJSON != tt.json {
+			t.Errorf("parseInterspersed(%q) = %q, -out %q, -json %v, want %q, %q, %v", tt.args, positional, *out, *asJSON, tt.positional, tt.out, tt.json)
+		}
+	}
+}
+
+func TestLookupWithoutSteam(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		flags []string
+		cfg   func(*config.Config)
+	}{
+		{"no cache", []string{"-no-cache"}, func(c *config.Config) { c.Valkey.Endpoint = "localhost:6379" }},
+		{"no Valkey", nil, func(c *config.Config) {}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("lookup", flag.ContinueOnError)
+			run := lookupCommand(flags)
+			args := parseInterspersed(flags, append(tt.flags, "gabelogannewell"))
+			cfg := config.Default()
+			tt.cfg(cfg)
+
+			if err := run(context.Background(), zerolog.Nop(), cfg, args); !errors.Is(err, errSteamAPIKey) {
+				t.Errorf("lookup error = %v, want %v", err, errSteamAPIKey)
+			}
+		})
+	}
+}
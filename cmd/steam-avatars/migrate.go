@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/rs/zerolog"
+)
+
+func migrateCommand(flags *flag.FlagSet) runFunc {
+	legacy := flags.Bool("legacy", false, "Also move the unprefixed keys written by older versions")
+
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		db, err := openDB(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		report, err := db.Migrate(ctx, *legacy)
+		log.Info().Int("scanned", report.Scanned).Int("upgraded", report.Upgraded).Int("legacy", report.Legacy).Msg("migration finished")
+
+		return err
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/download"
+	"github.com/mrmarble/steam-avatars/internal/render"
+	"github.com/mrmarble/steam-avatars/internal/server"
+	"github.com/mrmarble/steam-avatars/internal/steam"
+	"github.com/rs/zerolog"
+)
+
+var renderers = map[string]func(io.Writer, *database.User, render.Options) error{
+	"svg": render.SVG,
+	"png": render.PNG,
+	"gif": render.GIF,
+}
+
+func renderCommand(flags *flag.FlagSet) runFunc {
+	format := flags.String("format", "svg", "Output format: svg, png or gif")
+	out := flags.String("out", ".", "Directory the files are written to")
+	size := flags.Int("size", render.DefaultOptions.Size, "Width and height of the output in pixels")
+	shape := flags.String("shape", "square", "Shape of the avatar: square or circle")
+	frame := flags.Bool("frame", render.DefaultOptions.Frame, "Draw the avatar frame")
+	store := flags.String("store", "", "Directory where fetched users are kept between runs")
+	storeTTL := flags.Duration("store-ttl", 24*time.Hour, "How long users in the store are reused")
+
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, queries []string) error {
+		renderer, ok := renderers[*format]
+		if !ok {
+			return fmt.Errorf("unknown format %q", *format)
+		}
+		if *shape != "square" && *shape != "circle" {
+			return fmt.Errorf("unknown shape %q", *shape)
+		}
+		if *size <= 0 {
+			return fmt.Errorf("size must be positive")
+		}
+		if len(queries) == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		opts := render.Options{Size: *size, Circle: *shape == "circle", Frame: *frame}
+
+		if err := os.MkdirAll(*out, 0o755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+
+		var (
+			client     *steam.Client
+			downloader *download.Downloader
+		)
+		failed := 0
+		for _, query := range queries {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			query = steam.NormalizeQuery(query)
+
+			user, err := loadStoredUser(*store, query, *storeTTL)
+			if err != nil {
+				log.Warn().Err(err).Str("query", query).Msg("failed to read store")
+			}
+			if user == nil {
+				if client == nil {
+					if cfg.Steam.APIKey == "" {
+						return errSteamAPIKey
+					}
+					client = steam.NewClient(cfg.Steam)
+					downloader = download.New(cfg.Download)
+				}
+				user, err = server.SearchUser(ctx, client, downloader, query)
+				if err != nil {
+					log.Error().Err(err).Str("query", query).Msg("failed to fetch user")
+					failed++
+					continue
+				}
+				if err := saveStoredUser(*store, query, user); err != nil {
+					log.Warn().Err(err).Str("query", query).Msg("failed to write store")
+				}
+			}
+
+			path := outputPath(*out, user, *format)
+			if err := renderFile(path, renderer, user, opts); err != nil {
+				log.Error().Err(err).Str("query", query).Msg("failed to render avatar")
+				failed++
+				continue
+			}
+			log.Info().Str("query", query).Str("path", path).Msg("rendered avatar")
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("failed to render %d avatars", failed)
+		}
+
+		return nil
+	}
+}
+
+// outputPath returns where the avatar of a user is rendered to, named after
+// its SteamID so queries for the same user share the file.
+func outputPath(dir string, user *database.User, format string) string {
+	return filepath.Join(dir, strconv.FormatInt(user.ID, 10)+"."+format)
+}
+
+func renderFile(path string, renderer func(io.Writer, *database.User, render.Options) error, user *database.User, opts render.Options) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := renderer(f, user, opts); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
+
+// loadStoredUser returns the user stored for the query if it is younger than
+// ttl, or nil if there is none.
+func loadStoredUser(store, query string, ttl time.Duration) (*database.User, error) {
+	if store == "" {
+		return nil, nil
+	}
+
+	path := filepath.Join(store, query+".json")
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if time.Since(info.ModTime()) > ttl {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var user database.User
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func saveStoredUser(store, query string, user *database.User) error {
+	if store == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(store, 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(store, query+".json"), data, 0o644)
+}
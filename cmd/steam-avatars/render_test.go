@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/render"
+)
+
+func TestOutputPath(t *testing.T) {
+	user := &database.User{ID: 76561197960287930, VanityURL: "gabelogannewell"}
+
+	for _, format := range []string{"svg", "png", "gif"} {
+		want := filepath.Join("out", "76561197960287930."+format)
+		if got := outputPath("out", user, format); got != want {
+			t.Errorf("outputPath(%q) = %q, want %q", format, got, want)
+		}
+	}
+}
+
+func TestRenderFile(t *testing.T) {
+	user := &database.User{ID: 76561197960287930}
+	path := filepath.Join(t.TempDir(), "76561197960287930.svg")
+
+	failing := func(w io.Writer, user *database.User, opts render.Options) error {
+		io.WriteString(w, "<svg")
+		return errors.New("failed to decode avatar")
+	}
+	if err := renderFile(path, failing, user, render.DefaultOptions); err == nil {
+		t.Fatal("renderFile() succeeded with a failing renderer")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial output was left behind: %v", err)
+	}
+
+	working := func(w io.Writer, user *database.User, opts render.Options) error {
+		_, err := io.WriteString(w, "<svg/>")
+		return err
+	}
+	if err := renderFile(path, working, user, render.DefaultOptions); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "<svg/>" {
+		t.Errorf("output = %q (%v), want the rendered avatar", data, err)
+	}
+}
+
+func TestStoredUser(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "store")
+	user := &database.User{ID: 76561197960287930, DisplayName: "Rabscuttle"}
+
+	if got, err := loadStoredUser(store, "gabelogannewell", time.Hour); got != nil || err != nil {
+		t.Fatalf("loadStoredUser() = %v, %v before saving, want nothing", got, err)
+	}
+	if err := saveStoredUser(store, "gabelogannewell", user); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadStoredUser(store, "gabelogannewell", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.ID != user.ID || got.DisplayName != user.DisplayName {
+		t.Errorf("loadStoredUser() = %+v, want %+v", got, user)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(store, "gabelogannewell.json"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := loadStoredUser(store, "gabelogannewell", time.Hour); got != nil || err != nil {
+		t.Errorf("loadStoredUser() = %v, %v for an expired user, want nothing", got, err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/rs/zerolog"
+)
+
+func tokenCommand(flags *flag.FlagSet) runFunc {
+	rate := flags.Float64("rate", 100, "Requests per second allowed (create)")
+	burst := flags.Int("burst", 200, "Requests allowed at once (create)")
+	quota := flags.Int64("quota", 0, "Requests allowed per UTC day, 0 for unlimited (create)")
+	routes := flags.String("routes", "", `Comma separated routes the token can use, such as "/api/v1/*", all when empty (create)`)
+
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		if len(args) == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		action, args := args[0], args[1:]
+
+		db, err := openDB(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		switch {
+		case action == "create" && len(args) == 1:
+			if *rate <= 0 || *burst <= 0 {
+				return fmt.Errorf("-rate and -burst must be positive")
+			}
+			token := &database.Token{
+				Name:       args[0],
+				Rate:       *rate,
+				Burst:      *burst,
+				DailyQuota: *quota,
+			}
+			for _, route := range strings.Split(*routes, ",") {
+				if route = strings.TrimSpace(route); route != "" {
+					token.Routes = append(token.Routes, route)
+				}
+			}
+
+			secret, err := db.CreateToken(ctx, token)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Created token %s (%s). The secret is only shown once:\n", token.ID, token.Name)
+			fmt.Println(secret)
+			return nil
+		case action == "list" && len(args) == 0:
+			return printTokens(ctx, db)
+		case action == "revoke" && len(args) == 1:
+			deleted, err := db.DeleteToken(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				return fmt.Errorf("token %q not found", args[0])
+			}
+			fmt.Printf("Revoked token %s\n", args[0])
+			return nil
+		}
+
+		flags.Usage()
+		os.Exit(2)
+		return nil
+	}
+}
+
+func printTokens(ctx context.Context, db *database.Database) error {
+	tokens, err := db.ListTokens(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tRATE\tBURST\tQUOTA\tTODAY\tTOTAL\tLAST USED\tROUTES")
+	for _, token := range tokens {
+		usage, err := db.GetTokenUsage(ctx, token.ID)
+		if err != nil {
+			return err
+		}
+
+		quota, lastUsed, routes := "unlimited", "never", "all"
+		if token.DailyQuota > 0 {
+			quota = fmt.Sprint(token.DailyQuota)
+		}
+		if !usage.LastUsed.IsZero() {
+			lastUsed = usage.LastUsed.Format("2006-01-02 15:04")
+		}
+		if len(token.Routes) > 0 {
+			routes = strings.Join(token.Routes, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%g/s\t%d\t%s\t%d\t%d\t%s\t%s\n", token.ID, token.Name, token.Rate, token.Burst, quota, usage.Today, usage.Total, lastUsed, routes)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/download"
+	"github.com/mrmarble/steam-avatars/internal/server"
+	"github.com/mrmarble/steam-avatars/internal/steam"
+	"github.com/rs/zerolog"
+)
+
+// warmFailure is a line of the failure report.
+type warmFailure struct {
+	Query string `json:"query"`
+	Error string `json:"error"`
+}
+
+func warmCommand(flags *flag.FlagSet) runFunc {
+	input := flags.String("input", "-", "File with one SteamID, vanity name or profile URL per line or CSV row, - for stdin")
+	column := flags.Int("column", 0, "CSV column holding the SteamID or vanity name")
+	header := flags.Bool("header", false, "Skip the first row of the input")
+	concurrency := flags.Int("concurrency", 4, "Number of users fetched at the same time")
+	reportPath := flags.String("report", "", "Write failures as JSON lines to this file")
+	force := flags.Bool("force", false, "Fetch users that are already cached")
+
+	return func(ctx context.Context, log zerolog.Logger, cfg *config.Config, args []string) error {
+		queries, err := readWarmInput(*input, *column, *header)
+		if err != nil {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+
+		db, err := openDB(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		client := steam.NewClient(cfg.Steam)
+		downloader := download.New(cfg.Download)
+
+		warm := func(ctx context.Context, query string) (bool, error) {
+			return warmUser(ctx, db, client, downloader, query, *force)
+		}
+		done, skipped, failures := warmAll(ctx, log, queries, *concurrency, warm)
+
+		if *reportPath != "" {
+			if err := writeWarmReport(*reportPath, failures); err != nil {
+				log.Error().Err(err).Msg("failed to write report")
+			}
+		}
+
+		log.Info().Int64("done", done).Int64("skipped", skipped).Int("failed", len(failures)).Int("total", len(queries)).Msg("warming finished")
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("failed to warm %d users", len(failures))
+		}
+
+		return nil
+	}
+}
+
+// warmAll runs warm for every query on concurrency workers, logging the
+// progress, until they are all done or ctx is cancelled. It returns how many
+// were done and skipped, and the failures.
+func warmAll(ctx context.Context, log zerolog.Logger, queries []string, concurrency int, warm func(ctx context.Context, query string) (bool, error)) (int64, int64, []warmFailure) {
+	var (
+		done, skipped atomic.Int64
+		failures      []warmFailure
+		mu            sync.Mutex
+		wg            sync.WaitGroup
+	)
+
+	jobs := make(chan string)
+	for range max(1, concurrency) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for query := range jobs {
+				cached, err := warm(ctx, query)
+				if cached {
+					skipped.Add(1)
+				}
+				if err != nil {
+					log.Warn().Err(err).Str("query", query).Msg("failed to warm user")
+					mu.Lock()
+					failures = append(failures, warmFailure{Query: query, Error: err.Error()})
+					mu.Unlock()
+				}
+				done.Add(1)
+			}
+		}()
+	}
+
+	total := len(queries)
+	finished := make(chan struct{})
+	go func() {
+		progress := time.NewTicker(2 * time.Second)
+		defer progress.Stop()
+		for {
+			select {
+			case <-progress.C:
+				log.Info().Int64("done", done.Load()).Int("total", total).Msg("warming")
+			case <-finished:
+				return
+			}
+		}
+	}()
+
+feed:
+	for _, query := range queries {
+		select {
+		case jobs <- query:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(finished)
+
+	return done.Load(), skipped.Load(), failures
+}
+
+// warmUser fetches and stores the user unless it is already cached and force
+// is not set, reporting whether it was skipped.
+func warmUser(ctx context.Context, db *database.Database, client *steam.Client, downloader *download.Downloader, query string, force bool) (bool, error) {
+	if !force {
+		_, cached, err := server.FindUser(ctx, db, client, downloader, query)
+		return cached, err
+	}
+
+	user, err := server.SearchUser(ctx, client, downloader, query)
+	if err != nil {
+		return false, err
+	}
+
+	return false, db.CreateUser(ctx, user)
+}
+
+// readWarmInput returns the normalised, deduplicated queries of the input.
+func readWarmInput(path string, column int, header bool) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	seen := map[string]bool{}
+	var queries []string
+	for row := 0; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if header && row == 0 {
+			continue
+		}
+		if column >= len(record) {
+			return nil, fmt.Errorf("line %d has no column %d", row+1, column)
+		}
+
+		query := steam.NormalizeQuery(record[column])
+		if query == "" || seen[query] {
+			continue
+		}
+		seen[query] = true
+		queries = append(queries, query)
+	}
+
+	return queries, nil
+}
+
+func writeWarmReport(path string, failures []warmFailure) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, failure := range failures {
+		if err := enc.Encode(failure); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestReadWarmInput(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		input   string
+		column  int
+		header  bool
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "lines",
+			input: "76561197960287930\n" +
+				"# A comment\n" +
+				"\n" +
+				"https://steamcommunity.com/id/GabeLoganNewell/\n" +
+				"gabelogannewell\n" +
+				"https://steamcommunity.com/profiles/76561197960287930/?l=english\n",
+			want: []string{"76561197960287930", "gabelogannewell"},
+		},
+		{
+			name:   "CSV",
+			input:  "name,profile\nGabe, GabeLoganNewell\nRobin,76561197960287931\n",
+			column: 1,
+			header: true,
+			want:   []string{"gabelogannewell", "76561197960287931"},
+		},
+		{
+			name:    "missing column",
+			input:   "a,b\nc\n",
+			column:  1,
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "input.csv")
+			if err := os.WriteFile(path, []byte(tt.input), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readWarmInput(path, tt.column, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readWarmInput() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("readWarmInput() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarmAll(t *testing.T) {
+	queries := []string{"cached", "fetched", "failed"}
+	warm := func(ctx context.Context, query string) (bool, error) {
+		switch query {
+		case "cached":
+			return true, nil
+		case "failed":
+			return false, errors.New("steam user not found")
+		}
+		return false, nil
+	}
+
+	done, skipped, failures := warmAll(context.Background(), zerolog.Nop(), queries, 2, warm)
+	if done != 3 || skipped != 1 {
+		t.Errorf("done %d and skipped %d, want 3 and 1", done, skipped)
+	}
+	if len(failures) != 1 || failures[0].Query != "failed" {
+		t.Errorf("failures = %+v, want the failed query", failures)
+	}
+}
+
+func TestWarmAllCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queries := make([]string, 100)
+	for i := range queries {
+		queries[i] = "user"
+	}
+	var started atomic.Int64
+	warm := func(ctx context.Context, query string) (bool, error) {
+		if started.Add(1) == 2 {
+			cancel()
+		}
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+
+	finished := make(chan int64)
+	go func() {
+		done, _, _ := warmAll(ctx, zerolog.Nop(), queries, 2, warm)
+		finished <- done
+	}()
+
+	select {
+	case done := <-finished:
+		// The feed may hand out a few more queries before it notices.
+		if done >= int64(len(queries)) || done != started.Load() {
+			t.Errorf("done %d of %d queries after %d started, want the workers to stop", done, len(queries), started.Load())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers didn't stop after the context was cancelled")
+	}
+}
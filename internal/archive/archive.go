@@ -0,0 +1,313 @@
+// Package archive exports the stored users, their history and images to a
+// portable tar.gz archive, and imports such an archive back.
+//
+// The archive starts with a JSON-lines manifest of the records, with images
+// replaced by their hashes, followed by every image once under blobs/<hash>.
+// The MIME type of each image is kept in the user.mime_type extended attribute.
+// Users keep when they expire, and are restored as they were rather than
+// stored as if they had just been fetched.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/imagemeta"
+)
+
+const (
+	manifestName = "manifest.jsonl"
+	blobDir      = "blobs/"
+	mimeXattr    = "SCHILY.xattr.user.mime_type"
+)
+
+// Record is a line of the manifest.
+type Record struct {
+	Type      string                   `json:"type"` // user, history or aliases
+	User      *database.User           `json:"user,omitempty"`
+	ExpiresAt *time.Time               `json:"expires_at,omitempty"` // Of the user, missing in older archives
+	ID        int64                    `json:"id,omitempty"`
+	History   []*database.HistoryEntry `json:"history,omitempty"`
+	Aliases   []*database.AliasEntry   `json:"aliases,omitempty"`
+}
+
+// Report counts the records written or read.
+type Report struct {
+	Users     int `json:"users"`
+	Histories int `json:"histories"`
+	Aliases   int `json:"aliases"`
+	Blobs     int `json:"blobs"`
+}
+
+// Export writes every stored record and the images they reference to w.
+func Export(ctx context.Context, db *database.Database, w io.Writer) (*Report, error) {
+	report := &Report{}
+
+	var records []Record
+	// Images still embedded in a user record, in case they were never stored
+	// as a blob.
+	embedded := map[string]string{}
+	hashes := map[string]bool{}
+
+	if err := db.EachUser(ctx, func(user *database.User) error {
+		if user.AvatarHash != "" {
+			embedded[user.AvatarHash] = user.Avatar
+			hashes[user.AvatarHash] = true
+		}
+		if user.FrameHash != "" {
+			embedded[user.FrameHash] = user.Frame
+			hashes[user.FrameHash] = true
+		}
+		ttl, err := db.UserTTL(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("failed to read TTL of user %d: %w", user.ID, err)
+		}
+		if ttl <= 0 {
+			// Expired since it was read.
+			return nil
+		}
+		expiresAt := time.Now().Add(ttl).UTC()
+
+		stripped := *user
+		stripped.Avatar, stripped.Frame = "", ""
+		records = append(records, Record{Type: "user", User: &stripped, ExpiresAt: &expiresAt})
+		report.Users++
+		return nil
+	}); err != nil {
+		return report, err
+	}
+
+	if err := db.EachHistory(ctx, func(id int64, entries []*database.HistoryEntry) error {
+		for _, entry := range entries {
+			if entry.AvatarHash != "" {
+				hashes[entry.AvatarHash] = true
+			}
+			if entry.FrameHash != "" {
+				hashes[entry.FrameHash] = true
+			}
+		}
+		records = append(records, Record{Type: "history", ID: id, History: entries})
+		report.Histories++
+		return nil
+	}); err != nil {
+		return report, err
+	}
+
+	if err := db.EachAliases(ctx, func(id int64, entries []*database.AliasEntry) error {
+		records = append(records, Record{Type: "aliases", ID: id, Aliases: entries})
+		report.Aliases++
+		return nil
+	}); err != nil {
+		return report, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	var manifest strings.Builder
+	enc := json.NewEncoder(&manifest)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return report, err
+		}
+	}
+	if err := writeFile(tw, &tar.Header{Name: manifestName, ModTime: now}, []byte(manifest.String())); err != nil {
+		return report, err
+	}
+
+	for hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		uri, err := db.GetBlob(ctx, hash)
+		if err != nil {
+			var ok bool
+			if uri, ok = embedded[hash]; !ok {
+				return report, fmt.Errorf("failed to read image %s: %w", hash, err)
+			}
+		}
+
+		mime, data, err := database.DecodeDataURI(uri)
+		if err != nil {
+			return report, fmt.Errorf("failed to decode image %s: %w", hash, err)
+		}
+
+		header := &tar.Header{Name: blobDir + hash, ModTime: now, PAXRecords: map[string]string{mimeXattr: mime}}
+		if err := writeFile(tw, header, data); err != nil {
+			return report, err
+		}
+		report.Blobs++
+	}
+
+	if err := tw.Close(); err != nil {
+		return report, err
+	}
+
+	return report, gz.Close()
+}
+
+func writeFile(tw *tar.Writer, header *tar.Header, data []byte) error {
+	header.Typeflag = tar.TypeReg
+	header.Mode = 0o644
+	header.Size = int64(len(data))
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s: %w", header.Name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", header.Name, err)
+	}
+
+	return nil
+}
+
+// Import loads an archive written by Export into db. Every image is checked
+// against its hash before being stored, and images larger than maxSize bytes
+// are rejected. Users that expired since the export are skipped.
+func Import(ctx context.Context, db *database.Database, r io.Reader, maxSize int64) (*Report, error) {
+	report := &Report{}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return report, fmt.Errorf("failed to read archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	var records []Record
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return report, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		switch {
+		case header.Name == manifestName:
+			records, err = readManifest(tr)
+			if err != nil {
+				return report, err
+			}
+		case strings.HasPrefix(header.Name, blobDir):
+			if err := importBlob(ctx, db, header, tr, maxSize); err != nil {
+				return report, err
+			}
+			report.Blobs++
+		}
+	}
+	if records == nil {
+		return report, fmt.Errorf("archive has no %s", manifestName)
+	}
+
+	for _, record := range records {
+		var err error
+		switch record.Type {
+		case "history":
+			err = db.ReplaceHistory(ctx, record.ID, record.History)
+			report.Histories++
+		case "aliases":
+			err = db.ReplaceAliases(ctx, record.ID, record.Aliases)
+			report.Aliases++
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to import %s of %d: %w", record.Type, record.ID, err)
+		}
+	}
+
+	for _, record := range records {
+		if record.Type != "user" || record.User == nil {
+			continue
+		}
+
+		var ttl time.Duration // The default for older archives
+		if record.ExpiresAt != nil {
+			if ttl = time.Until(*record.ExpiresAt); ttl <= 0 {
+				continue
+			}
+		}
+
+		user := record.User
+		if user.Avatar, err = blobOrEmpty(ctx, db, user.AvatarHash); err != nil {
+			return report, fmt.Errorf("failed to import user %d: %w", user.ID, err)
+		}
+		if user.Frame, err = blobOrEmpty(ctx, db, user.FrameHash); err != nil {
+			return report, fmt.Errorf("failed to import user %d: %w", user.ID, err)
+		}
+		if err := db.RestoreUser(ctx, user, ttl); err != nil {
+			return report, fmt.Errorf("failed to import user %d: %w", user.ID, err)
+		}
+		report.Users++
+	}
+
+	return report, nil
+}
+
+func readManifest(r io.Reader) ([]Record, error) {
+	var records []Record
+	dec := json.NewDecoder(r)
+	for {
+		var record Record
+		if err := dec.Decode(&record); errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", manifestName, err)
+		}
+		records = append(records, record)
+	}
+}
+
+func importBlob(ctx context.Context, db *database.Database, header *tar.Header, r io.Reader, maxSize int64) error {
+	hash := path.Base(header.Name)
+	if header.Size > maxSize {
+		return fmt.Errorf("image %s is larger than %d bytes", hash, maxSize)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", header.Name, err)
+	}
+	if int64(len(data)) > maxSize {
+		return fmt.Errorf("image %s is larger than %d bytes", hash, maxSize)
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("image %s does not match its hash", hash)
+	}
+
+	mime := header.PAXRecords[mimeXattr]
+	if mime == "" {
+		mime = imagemeta.Sniff(data)
+	}
+	if mime == "" {
+		mime = http.DetectContentType(data)
+	}
+
+	return db.StoreBlob(ctx, hash, fmt.Sprintf("data:%s;base64,%s", mime, base64.StdEncoding.EncodeToString(data)))
+}
+
+func blobOrEmpty(ctx context.Context, db *database.Database, hash string) (string, error) {
+	if hash == "" {
+		return "", nil
+	}
+
+	return db.GetBlob(ctx, hash)
+}
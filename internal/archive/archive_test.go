@@ -0,0 +1,27 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestImportRejectsLargeImages(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := writeFile(tw, &tar.Header{Name: blobDir + "abc"}, make([]byte, 101)); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	gz.Close()
+
+	// The image is rejected before anything is stored.
+	_, err := Import(context.Background(), nil, &buf, 100)
+	if err == nil || !strings.Contains(err.Error(), "larger than 100 bytes") {
+		t.Errorf("Import() error = %v, want the image rejected as too large", err)
+	}
+}
@@ -0,0 +1,549 @@
+// Package config loads the settings shared by every command. Each setting is
+// taken from the first of these that sets it: command line flags, environment
+// variables, the config file and the defaults. The config file is TOML if its
+// name ends in .toml and YAML otherwise.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Valkey   ValkeyConfig   `yaml:"valkey" toml:"valkey"`
+	Steam    SteamConfig    `yaml:"steam" toml:"steam"`
+	Server   ServerConfig   `yaml:"server" toml:"server"`
+	Refresh  RefreshConfig  `yaml:"refresh" toml:"refresh"`
+	Tracing  TracingConfig  `yaml:"tracing" toml:"tracing"`
+	Health   HealthConfig   `yaml:"health" toml:"health"`
+	Proxy    ProxyConfig    `yaml:"proxy" toml:"proxy"`
+	Limits   LimitsConfig   `yaml:"limits" toml:"limits"`
+	Download DownloadConfig `yaml:"download" toml:"download"`
+	Security SecurityConfig `yaml:"security" toml:"security"`
+	Cache    CacheConfig    `yaml:"cache" toml:"cache"`
+	Purge    PurgeConfig    `yaml:"purge" toml:"purge"`
+	Webhooks WebhooksConfig `yaml:"webhooks" toml:"webhooks"`
+	History  HistoryConfig  `yaml:"history" toml:"history"`
+}
+
+type ValkeyConfig struct {
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	Prefix   string `yaml:"prefix" toml:"prefix"` // Prepended to every key
+}
+
+type SteamConfig struct {
+	APIKey    string  `yaml:"api_key" toml:"api_key"`
+	RateLimit float64 `yaml:"rate_limit" toml:"rate_limit"` // Requests per second
+	APIURL    string  `yaml:"api_url" toml:"api_url"`       // Base URL of the Steam Web API
+}
+
+type ServerConfig struct {
+	Address      string        `yaml:"address" toml:"address"`             // host:port, or unix:/path for a Unix domain socket
+	AdminAddress string        `yaml:"admin_address" toml:"admin_address"` // Serve /metrics and the probes here instead of on Address
+	TLSCert      string        `yaml:"tls_cert" toml:"tls_cert"`           // Serve HTTPS with this certificate, reloaded when it changes
+	TLSKey       string        `yaml:"tls_key" toml:"tls_key"`
+	DrainDelay   time.Duration `yaml:"drain_delay" toml:"drain_delay"` // How long /readyz fails before the listener closes
+	AssetsDir    string        `yaml:"assets_dir" toml:"assets_dir"`   // Serve the static files from here instead of the binary, for development
+}
+
+type RefreshConfig struct {
+	Enabled  bool          `yaml:"enabled" toml:"enabled"`
+	Interval time.Duration `yaml:"interval" toml:"interval"` // How often popular users are checked
+	Top      int           `yaml:"top" toml:"top"`           // Number of most requested users kept fresh
+	Before   time.Duration `yaml:"before" toml:"before"`     // Refresh records expiring within this window
+	Cooldown time.Duration `yaml:"cooldown" toml:"cooldown"` // Between manual refreshes of a user
+}
+
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"`         // OTLP/HTTP collector, tracing is disabled when empty
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"` // Fraction of new traces that are recorded
+}
+
+type HealthConfig struct {
+	SteamCheck    bool          `yaml:"steam_check" toml:"steam_check"`       // Include the Steam Web API in /readyz
+	SteamInterval time.Duration `yaml:"steam_interval" toml:"steam_interval"` // How long a Steam check result is reused
+}
+
+// ProxyConfig lists the reverse proxies whose X-Forwarded-For header is
+// trusted to find the client address.
+type ProxyConfig struct {
+	Trusted          []string `yaml:"trusted" toml:"trusted"`                     // CIDRs of the proxies in front of the server
+	CloudflareRanges string   `yaml:"cloudflare_ranges" toml:"cloudflare_ranges"` // File with the Cloudflare CIDRs, one per line
+	ForwardedDepth   int      `yaml:"forwarded_depth" toml:"forwarded_depth"`     // Take the client from this position from the end of X-Forwarded-For instead
+}
+
+// LimitsConfig sets how many requests each client can make. Requests that
+// fetch a user from Steam count against both limits.
+type LimitsConfig struct {
+	Requests RateLimit `yaml:"requests" toml:"requests"` // Every request
+	Upstream RateLimit `yaml:"upstream" toml:"upstream"` // Requests for users that aren't stored yet
+}
+
+type RateLimit struct {
+	Rate  float64 `yaml:"rate" toml:"rate"`   // Requests per second
+	Burst int     `yaml:"burst" toml:"burst"` // Requests allowed at once
+}
+
+// DownloadConfig restricts the images downloaded from the Steam CDN.
+type DownloadConfig struct {
+	Hosts   []string      `yaml:"hosts" toml:"hosts"`       // Allowed hosts, "*.example.com" allows subdomains
+	MaxSize int           `yaml:"max_size" toml:"max_size"` // In bytes
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// SecurityConfig sets who may embed the site, as CSP frame-ancestors sources.
+type SecurityConfig struct {
+	FrameAncestors      []string `yaml:"frame_ancestors" toml:"frame_ancestors"`             // For the HTML pages
+	ImageFrameAncestors []string `yaml:"image_frame_ancestors" toml:"image_frame_ancestors"` // For the avatar SVGs and images
+}
+
+// CacheConfig sets how long browsers and CDNs cache the avatars.
+type CacheConfig struct {
+	MaxAge               time.Duration `yaml:"max_age" toml:"max_age"`                               // For browsers
+	SharedMaxAge         time.Duration `yaml:"shared_max_age" toml:"shared_max_age"`                 // For CDNs, as s-maxage
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate" toml:"stale_while_revalidate"` // How long a stale avatar is served while it's revalidated
+}
+
+// PurgeConfig sets the CDN caches purged when an avatar changes.
+type PurgeConfig struct {
+	BaseURL         string        `yaml:"base_url" toml:"base_url"` // Public URL of the site, the purged URLs are under it
+	Webhook         string        `yaml:"webhook" toml:"webhook"`   // POSTed the purged URLs and tags as JSON
+	WebhookToken    string        `yaml:"webhook_token" toml:"webhook_token"`
+	CloudflareZone  string        `yaml:"cloudflare_zone" toml:"cloudflare_zone"`
+	CloudflareToken string        `yaml:"cloudflare_token" toml:"cloudflare_token"`
+	CloudflareAPI   string        `yaml:"cloudflare_api" toml:"cloudflare_api"`       // Base URL of the Cloudflare API
+	CloudflareByTag bool          `yaml:"cloudflare_by_tag" toml:"cloudflare_by_tag"` // Purge by Cache-Tag instead of URL, an Enterprise feature
+	Timeout         time.Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// WebhooksConfig sets how the events of the webhook subscriptions are
+// delivered.
+type WebhooksConfig struct {
+	Attempts     int           `yaml:"attempts" toml:"attempts"`           // Per event, the first one included
+	Backoff      time.Duration `yaml:"backoff" toml:"backoff"`             // Before the first retry, doubled after each
+	Timeout      time.Duration `yaml:"timeout" toml:"timeout"`             // Of each attempt
+	DisableAfter int           `yaml:"disable_after" toml:"disable_after"` // Events failed in a row before a webhook is disabled
+	MaxPerToken  int           `yaml:"max_per_token" toml:"max_per_token"`
+}
+
+// HistoryConfig bounds the history and aliases kept for each user.
+type HistoryConfig struct {
+	MaxEntries int           `yaml:"max_entries" toml:"max_entries"` // Per user, the oldest are dropped first, 0 for unlimited
+	Retention  time.Duration `yaml:"retention" toml:"retention"`     // Since a user was last stored, 0 to keep forever
+}
+
+// Default returns the configuration used when nothing else is set.
+func Default() *Config {
+	return &Config{
+		Steam: SteamConfig{
+			RateLimit: 5,
+			APIURL:    "https://api.steampowered.com",
+		},
+		Server: ServerConfig{
+			Address:    ":8080",
+			DrainDelay: 5 * time.Second,
+		},
+		Refresh: RefreshConfig{
+			Enabled:  true,
+			Interval: 5 * time.Minute,
+			Top:      100,
+			Before:   time.Hour,
+			Cooldown: 5 * time.Minute,
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 1,
+		},
+		Health: HealthConfig{
+			SteamInterval: time.Minute,
+		},
+		Limits: LimitsConfig{
+			Requests: RateLimit{Rate: 20, Burst: 20},
+			Upstream: RateLimit{Rate: 0.5, Burst: 5},
+		},
+		Download: DownloadConfig{
+			Hosts:   []string{"*.steamstatic.com", "steamcdn-a.akamaihd.net", "steamuserimages-a.akamaihd.net"},
+			MaxSize: 10 << 20,
+			Timeout: 10 * time.Second,
+		},
+		Security: SecurityConfig{
+			FrameAncestors:      []string{"'self'"},
+			ImageFrameAncestors: []string{"*"},
+		},
+		Cache: CacheConfig{
+			MaxAge:               5 * time.Minute,
+			SharedMaxAge:         time.Hour,
+			StaleWhileRevalidate: 24 * time.Hour,
+		},
+		Purge: PurgeConfig{
+			CloudflareAPI: "https://api.cloudflare.com/client/v4",
+			Timeout:       10 * time.Second,
+		},
+		Webhooks: WebhooksConfig{
+			Attempts:     5,
+			Backoff:      2 * time.Second,
+			Timeout:      10 * time.Second,
+			DisableAfter: 10,
+			MaxPerToken:  10,
+		},
+		History: HistoryConfig{
+			MaxEntries: 100,
+			Retention:  365 * 24 * time.Hour,
+		},
+	}
+}
+
+// Requirement is a dependency a command needs to be configured.
+type Requirement int
+
+const (
+	NeedValkey Requirement = 1 << iota
+	NeedSteam
+)
+
+// Validate returns every problem with the configuration at once.
+func (c *Config) Validate(needs Requirement) error {
+	var errs []error
+
+	if needs&NeedValkey != 0 && c.Valkey.Endpoint == "" {
+		errs = append(errs, errors.New("valkey.endpoint (VALKEY_ENDPOINT) is required"))
+	}
+	if needs&NeedSteam != 0 && c.Steam.APIKey == "" {
+		errs = append(errs, errors.New("steam.api_key (STEAM_API_KEY) is required"))
+	}
+	if c.Steam.RateLimit <= 0 {
+		errs = append(errs, errors.New("steam.rate_limit must be positive"))
+	}
+	if c.Server.Address == "" {
+		errs = append(errs, errors.New("server.address is required"))
+	}
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		errs = append(errs, errors.New("server.tls_cert and server.tls_key must be set together"))
+	}
+	if c.Server.AdminAddress != "" && c.Server.AdminAddress == c.Server.Address {
+		errs = append(errs, errors.New("server.admin_address must differ from server.address"))
+	}
+	if c.Server.DrainDelay < 0 {
+		errs = append(errs, errors.New("server.drain_delay must not be negative"))
+	}
+	if c.Refresh.Enabled {
+		if c.Refresh.Interval <= 0 {
+			errs = append(errs, errors.New("refresh.interval must be positive"))
+		}
+		if c.Refresh.Top <= 0 {
+			errs = append(errs, errors.New("refresh.top must be positive"))
+		}
+		if c.Refresh.Before < 0 {
+			errs = append(errs, errors.New("refresh.before must not be negative"))
+		}
+	}
+	if c.Refresh.Cooldown <= 0 {
+		errs = append(errs, errors.New("refresh.cooldown must be positive"))
+	}
+
+	if c.Proxy.ForwardedDepth < 0 {
+		errs = append(errs, errors.New("proxy.forwarded_depth must not be negative"))
+	}
+	if c.Limits.Requests.Rate <= 0 || c.Limits.Requests.Burst <= 0 {
+		errs = append(errs, errors.New("limits.requests.rate and limits.requests.burst must be positive"))
+	}
+	if c.Limits.Upstream.Rate <= 0 || c.Limits.Upstream.Burst <= 0 {
+		errs = append(errs, errors.New("limits.upstream.rate and limits.upstream.burst must be positive"))
+	}
+	if len(c.Download.Hosts) == 0 {
+		errs = append(errs, errors.New("download.hosts must not be empty"))
+	}
+	if c.Download.MaxSize <= 0 {
+		errs = append(errs, errors.New("download.max_size must be positive"))
+	}
+	if c.Download.Timeout <= 0 {
+		errs = append(errs, errors.New("download.timeout must be positive"))
+	}
+	if len(c.Security.FrameAncestors) == 0 || len(c.Security.ImageFrameAncestors) == 0 {
+		errs = append(errs, errors.New("security.frame_ancestors and security.image_frame_ancestors must not be empty, use 'none' to forbid embedding"))
+	}
+	if c.Cache.MaxAge < 0 || c.Cache.SharedMaxAge < 0 || c.Cache.StaleWhileRevalidate < 0 {
+		errs = append(errs, errors.New("cache.max_age, cache.shared_max_age and cache.stale_while_revalidate must not be negative"))
+	}
+	if (c.Purge.CloudflareZone == "") != (c.Purge.CloudflareToken == "") {
+		errs = append(errs, errors.New("purge.cloudflare_zone and purge.cloudflare_token must be set together"))
+	}
+	if c.Purge.BaseURL == "" && (c.Purge.Webhook != "" || c.Purge.CloudflareZone != "" && !c.Purge.CloudflareByTag) {
+		errs = append(errs, errors.New("purge.base_url is required to purge by URL"))
+	}
+	if c.Purge.Timeout <= 0 {
+		errs = append(errs, errors.New("purge.timeout must be positive"))
+	}
+	if c.Webhooks.Attempts <= 0 || c.Webhooks.DisableAfter <= 0 || c.Webhooks.MaxPerToken <= 0 {
+		errs = append(errs, errors.New("webhooks.attempts, webhooks.disable_after and webhooks.max_per_token must be positive"))
+	}
+	if c.Webhooks.Backoff < 0 || c.Webhooks.Timeout <= 0 {
+		errs = append(errs, errors.New("webhooks.backoff must not be negative and webhooks.timeout must be positive"))
+	}
+	if c.History.MaxEntries < 0 || c.History.Retention < 0 {
+		errs = append(errs, errors.New("history.max_entries and history.retention must not be negative"))
+	}
+	if c.Health.SteamCheck && c.Health.SteamInterval <= 0 {
+		errs = append(errs, errors.New("health.steam_interval must be positive"))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, errors.New("tracing.sample_ratio must be between 0 and 1"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// setting binds a field of Config to its flag and environment variable.
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	secret bool
+	field  func(*Config) any // Pointer to the field
+}
+
+func settings() []setting {
+	return []setting{
+		{flag: "valkey-endpoint", env: "VALKEY_ENDPOINT", usage: "Address of the Valkey server", field: func(c *Config) any { return &c.Valkey.Endpoint }},
+		{flag: "prefix", env: "VALKEY_PREFIX", usage: "Prefix of every Valkey key", field: func(c *Config) any { return &c.Valkey.Prefix }},
+		{flag: "key", env: "STEAM_API_KEY", usage: "Steam API key", secret: true, field: func(c *Config) any { return &c.Steam.APIKey }},
+		{flag: "steam-rate-limit", env: "STEAM_RATE_LIMIT", usage: "Maximum Steam Web API requests per second", field: func(c *Config) any { return &c.Steam.RateLimit }},
+		{flag: "steam-api", env: "STEAM_API", usage: "Base URL of the Steam Web API", field: func(c *Config) any { return &c.Steam.APIURL }},
+		{flag: "listen", env: "LISTEN_ADDRESS", usage: "Address the server listens on", field: func(c *Config) any { return &c.Server.Address }},
+		{flag: "admin-listen", env: "ADMIN_ADDRESS", usage: "Separate address /metrics and the health probes are served on", field: func(c *Config) any { return &c.Server.AdminAddress }},
+		{flag: "tls-cert", env: "TLS_CERT_FILE", usage: "TLS certificate file, enables HTTPS", field: func(c *Config) any { return &c.Server.TLSCert }},
+		{flag: "tls-key", env: "TLS_KEY_FILE", usage: "TLS private key file", field: func(c *Config) any { return &c.Server.TLSKey }},
+		{flag: "drain-delay", env: "DRAIN_DELAY", usage: "How long /readyz fails before the server stops accepting connections", field: func(c *Config) any { return &c.Server.DrainDelay }},
+		{flag: "assets-dir", env: "ASSETS_DIR", usage: "Serve the static files from this directory instead of the embedded ones, for development", field: func(c *Config) any { return &c.Server.AssetsDir }},
+		{flag: "refresh", env: "REFRESH_ENABLED", usage: "Keep the most requested avatars fresh in the background", field: func(c *Config) any { return &c.Refresh.Enabled }},
+		{flag: "refresh-interval", env: "REFRESH_INTERVAL", usage: "How often the most requested avatars are checked", field: func(c *Config) any { return &c.Refresh.Interval }},
+		{flag: "refresh-top", env: "REFRESH_TOP", usage: "Number of most requested avatars kept fresh", field: func(c *Config) any { return &c.Refresh.Top }},
+		{flag: "refresh-before", env: "REFRESH_BEFORE", usage: "Refresh avatars expiring within this window", field: func(c *Config) any { return &c.Refresh.Before }},
+		{flag: "refresh-cooldown", env: "REFRESH_COOLDOWN", usage: "How long before a user can be refreshed again on request", field: func(c *Config) any { return &c.Refresh.Cooldown }},
+		{flag: "otlp-endpoint", env: "OTEL_EXPORTER_OTLP_ENDPOINT", usage: "OTLP/HTTP endpoint traces are exported to", field: func(c *Config) any { return &c.Tracing.Endpoint }},
+		{flag: "trace-sample-ratio", env: "TRACE_SAMPLE_RATIO", usage: "Fraction of new traces that are recorded", field: func(c *Config) any { return &c.Tracing.SampleRatio }},
+		{flag: "trusted-proxies", env: "TRUSTED_PROXIES", usage: "Comma separated CIDRs of the reverse proxies in front of the server", field: func(c *Config) any { return &c.Proxy.Trusted }},
+		{flag: "cloudflare-ranges", env: "CLOUDFLARE_RANGES_FILE", usage: "File with the Cloudflare IP ranges to trust, one per line", field: func(c *Config) any { return &c.Proxy.CloudflareRanges }},
+		{flag: "forwarded-depth", env: "FORWARDED_DEPTH", usage: "Position of the client address from the end of X-Forwarded-For", field: func(c *Config) any { return &c.Proxy.ForwardedDepth }},
+		{flag: "rate-limit", env: "RATE_LIMIT", usage: "Requests per second allowed per client", field: func(c *Config) any { return &c.Limits.Requests.Rate }},
+		{flag: "rate-limit-burst", env: "RATE_LIMIT_BURST", usage: "Requests allowed at once per client", field: func(c *Config) any { return &c.Limits.Requests.Burst }},
+		{flag: "upstream-rate-limit", env: "UPSTREAM_RATE_LIMIT", usage: "Lookups of new users from Steam per second allowed per client", field: func(c *Config) any { return &c.Limits.Upstream.Rate }},
+		{flag: "upstream-rate-limit-burst", env: "UPSTREAM_RATE_LIMIT_BURST", usage: "Lookups of new users from Steam allowed at once per client", field: func(c *Config) any { return &c.Limits.Upstream.Burst }},
+		{flag: "download-hosts", env: "DOWNLOAD_HOSTS", usage: "Comma separated hosts images can be downloaded from", field: func(c *Config) any { return &c.Download.Hosts }},
+		{flag: "download-max-size", env: "DOWNLOAD_MAX_SIZE", usage: "Largest image downloaded, in bytes", field: func(c *Config) any { return &c.Download.MaxSize }},
+		{flag: "download-timeout", env: "DOWNLOAD_TIMEOUT", usage: "Timeout of an image download", field: func(c *Config) any { return &c.Download.Timeout }},
+		{flag: "frame-ancestors", env: "FRAME_ANCESTORS", usage: "Comma separated sources allowed to embed the pages", field: func(c *Config) any { return &c.Security.FrameAncestors }},
+		{flag: "image-frame-ancestors", env: "IMAGE_FRAME_ANCESTORS", usage: "Comma separated sources allowed to embed the avatars", field: func(c *Config) any { return &c.Security.ImageFrameAncestors }},
+		{flag: "cache-max-age", env: "CACHE_MAX_AGE", usage: "How long browsers cache an avatar", field: func(c *Config) any { return &c.Cache.MaxAge }},
+		{flag: "cache-shared-max-age", env: "CACHE_SHARED_MAX_AGE", usage: "How long CDNs cache an avatar", field: func(c *Config) any { return &c.Cache.SharedMaxAge }},
+		{flag: "cache-stale-while-revalidate", env: "CACHE_STALE_WHILE_REVALIDATE", usage: "How long a stale avatar is served while it's revalidated", field: func(c *Config) any { return &c.Cache.StaleWhileRevalidate }},
+		{flag: "purge-base-url", env: "PURGE_BASE_URL", usage: "Public URL of the site, under which avatar URLs are purged", field: func(c *Config) any { return &c.Purge.BaseURL }},
+		{flag: "purge-webhook", env: "PURGE_WEBHOOK", usage: "URL POSTed the avatar URLs and cache tags to purge", field: func(c *Config) any { return &c.Purge.Webhook }},
+		{flag: "purge-webhook-token", env: "PURGE_WEBHOOK_TOKEN", usage: "Bearer token sent to the purge webhook", secret: true, field: func(c *Config) any { return &c.Purge.WebhookToken }},
+		{flag: "cloudflare-zone", env: "CLOUDFLARE_ZONE_ID", usage: "Cloudflare zone whose cache is purged", field: func(c *Config) any { return &c.Purge.CloudflareZone }},
+		{flag: "cloudflare-token", env: "CLOUDFLARE_API_TOKEN", usage: "Cloudflare API token with the Cache Purge permission", secret: true, field: func(c *Config) any { return &c.Purge.CloudflareToken }},
+		{flag: "cloudflare-api", env: "CLOUDFLARE_API", usage: "Base URL of the Cloudflare API", field: func(c *Config) any { return &c.Purge.CloudflareAPI }},
+		{flag: "cloudflare-purge-by-tag", env: "CLOUDFLARE_PURGE_BY_TAG", usage: "Purge Cloudflare by cache tag instead of URL", field: func(c *Config) any { return &c.Purge.CloudflareByTag }},
+		{flag: "purge-timeout", env: "PURGE_TIMEOUT", usage: "Timeout of a purge request", field: func(c *Config) any { return &c.Purge.Timeout }},
+		{flag: "webhook-attempts", env: "WEBHOOK_ATTEMPTS", usage: "Attempts to deliver a webhook event", field: func(c *Config) any { return &c.Webhooks.Attempts }},
+		{flag: "webhook-backoff", env: "WEBHOOK_BACKOFF", usage: "Delay before the first webhook retry, doubled after each", field: func(c *Config) any { return &c.Webhooks.Backoff }},
+		{flag: "webhook-timeout", env: "WEBHOOK_TIMEOUT", usage: "Timeout of a webhook delivery attempt", field: func(c *Config) any { return &c.Webhooks.Timeout }},
+		{flag: "webhook-disable-after", env: "WEBHOOK_DISABLE_AFTER", usage: "Failed webhook events in a row before the webhook is disabled", field: func(c *Config) any { return &c.Webhooks.DisableAfter }},
+		{flag: "webhook-max-per-token", env: "WEBHOOK_MAX_PER_TOKEN", usage: "Webhooks an API token can create", field: func(c *Config) any { return &c.Webhooks.MaxPerToken }},
+		{flag: "history-max-entries", env: "HISTORY_MAX_ENTRIES", usage: "History and alias entries kept per user, 0 for unlimited", field: func(c *Config) any { return &c.History.MaxEntries }},
+		{flag: "history-retention", env: "HISTORY_RETENTION", usage: "How long the history and images of a user are kept after it was last stored, 0 to keep forever", field: func(c *Config) any { return &c.History.Retention }},
+		{flag: "health-steam-check", env: "HEALTH_STEAM_CHECK", usage: "Check the Steam Web API in /readyz", field: func(c *Config) any { return &c.Health.SteamCheck }},
+		{flag: "health-steam-interval", env: "HEALTH_STEAM_INTERVAL", usage: "How long a Steam Web API check is reused", field: func(c *Config) any { return &c.Health.SteamInterval }},
+	}
+}
+
+// set parses value into the field pointed to by ptr.
+func set(ptr any, value string) error {
+	var err error
+	switch p := ptr.(type) {
+	case *string:
+		*p = value
+	case *bool:
+		*p, err = strconv.ParseBool(value)
+	case *int:
+		*p, err = strconv.Atoi(value)
+	case *float64:
+		*p, err = strconv.ParseFloat(value, 64)
+	case *time.Duration:
+		*p, err = time.ParseDuration(value)
+	case *[]string:
+		*p = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+	default:
+		panic(fmt.Sprintf("config: unsupported field type %T", ptr))
+	}
+
+	return err
+}
+
+// rawFlag records the value of a flag so it can be applied after the config
+// file and the environment.
+type rawFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *rawFlag) String() string     { return f.value }
+func (f *rawFlag) Set(v string) error { f.value = v; return nil }
+func (f *rawFlag) IsBoolFlag() bool   { return f.isBool }
+
+// Loader registers the configuration flags on a flag set and builds the
+// configuration once it has been parsed.
+type Loader struct {
+	flags *flag.FlagSet
+	path  *string
+	raw   map[string]*rawFlag
+}
+
+func NewLoader(flags *flag.FlagSet) *Loader {
+	l := &Loader{
+		flags: flags,
+		path:  flags.String("config", os.Getenv("STEAM_AVATARS_CONFIG"), "YAML or TOML config file"),
+		raw:   map[string]*rawFlag{},
+	}
+
+	defaults := Default()
+	for _, s := range settings() {
+		ptr := s.field(defaults)
+		_, isBool := ptr.(*bool)
+		raw := &rawFlag{isBool: isBool}
+		l.raw[s.flag] = raw
+
+		usage := fmt.Sprintf("%s (%s)", s.usage, s.env)
+		if def := fmt.Sprint(deref(ptr)); def != "" && def != "0" && def != "false" {
+			usage += fmt.Sprintf(" (default %s)", def)
+		}
+		flags.Var(raw, s.flag, usage)
+	}
+
+	return l
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment and the flags that were set, in that order. The configuration is
+// returned along with the errors of the config file and of every setting that
+// could not be parsed, so they can be reported with the validation errors.
+func (l *Loader) Load() (*Config, error) {
+	cfg := Default()
+	var errs []error
+
+	if *l.path != "" {
+		if err := readFile(*l.path, cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, s := range settings() {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := set(s.field(cfg), value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+
+	l.flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings() {
+			if s.flag == f.Name {
+				if err := set(s.field(cfg), l.raw[s.flag].value); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", s.flag, err))
+				}
+			}
+		}
+	})
+
+	return cfg, errors.Join(errs...)
+}
+
+// readFile decodes a config file into cfg, rejecting unknown keys.
+func readFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to parse config file: %w", err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("failed to parse config file: unknown keys %s", strings.Join(keys, ", "))
+		}
+		return nil
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the configuration with the secrets hidden.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	for _, s := range settings() {
+		if !s.secret {
+			continue
+		}
+		if p, ok := s.field(&redacted).(*string); ok && *p != "" {
+			*p = "REDACTED"
+		}
+	}
+
+	return &redacted
+}
+
+// String returns the configuration as YAML with the secrets hidden.
+func (c *Config) String() string {
+	data, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+func deref(ptr any) any {
+	switch p := ptr.(type) {
+	case *string:
+		return *p
+	case *bool:
+		return *p
+	case *int:
+		return *p
+	case *float64:
+		return *p
+	case *time.Duration:
+		return *p
+	case *[]string:
+		return strings.Join(*p, ",")
+	}
+
+	return nil
+}
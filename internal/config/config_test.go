@@ -0,0 +1,81 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load loads a config file with the given name and content.
+func load(t *testing.T, name, content string) (*Config, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader := NewLoader(flags)
+	if err := flags.Parse([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	return loader.Load()
+}
+
+func TestLoadFile(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+	}{
+		{"config.yaml", "refresh:\n  top: 7\n  interval: 90s\nproxy:\n  trusted: [10.0.0.0/8]\n"},
+		{"config.toml", "[refresh]\ntop = 7\ninterval = \"90s\"\n\n[proxy]\ntrusted = [\"10.0.0.0/8\"]\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.name, tt.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Refresh.Top != 7 || cfg.Refresh.Interval != 90*time.Second {
+				t.Errorf("refresh = %+v, want top 7 every 90s", cfg.Refresh)
+			}
+			if len(cfg.Proxy.Trusted) != 1 || cfg.Proxy.Trusted[0] != "10.0.0.0/8" {
+				t.Errorf("proxy.trusted = %v, want [10.0.0.0/8]", cfg.Proxy.Trusted)
+			}
+			if cfg.Refresh.Before != Default().Refresh.Before {
+				t.Errorf("refresh.before = %v, want the default", cfg.Refresh.Before)
+			}
+		})
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"config.yaml", "refresh:\n  topp: 7\n", "field topp not found"},
+		{"config.toml", "[refresh]\ntopp = 7\n", "unknown keys refresh.topp"},
+		{"config.yml", "refresh: [\n", "failed to parse config file"},
+		{"config.toml", "[refresh\n", "failed to parse config file"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.name, tt.content)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want %q", err, tt.want)
+			}
+			// The configuration is still returned so it can be validated.
+			if cfg == nil {
+				t.Fatal("Load() returned no configuration")
+			}
+			if err := cfg.Validate(NeedValkey); err == nil {
+				t.Error("Validate() = nil, want the missing endpoint")
+			}
+		})
+	}
+}
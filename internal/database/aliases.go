@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+func (db *Database) aliasesKey(id int64) string {
+	return db.key("aliases", strconv.FormatInt(id, 10))
+}
+
+func (db *Database) vanityOwnersKey(vanityURL string) string {
+	return db.key("vanity_owners", vanityURL)
+}
+
+func newAliasEntry(user *User, now time.Time) AliasEntry {
+	return AliasEntry{
+		Version:     SchemaVersion,
+		Timestamp:   now,
+		PersonaName: user.DisplayName,
+		VanityURL:   user.VanityURL,
+	}
+}
+
+// sameNames reports whether the user still has the names of the entry.
+func (e *AliasEntry) sameNames(user *User) bool {
+	return e.PersonaName == user.DisplayName && e.VanityURL == user.VanityURL
+}
+
+// GetAliases returns the persona names and vanity URLs of a user, oldest entry first.
+func (db *Database) GetAliases(ctx context.Context, id int64) ([]*AliasEntry, error) {
+	ctx, span := tracing.Start(ctx, "database.GetAliases")
+	defer span.End()
+
+	var entries []*AliasEntry
+
+	if err := valkey.DecodeSliceOfJSON(db.client.Do(ctx, db.client.B().Lrange().Key(db.aliasesKey(id)).Start(0).Stop(-1).Build()), &entries); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		upgradeAliasEntry(entry)
+	}
+
+	return entries, nil
+}
+
+// GetVanityOwners returns every user that has used the vanity URL, most recent first.
+func (db *Database) GetVanityOwners(ctx context.Context, vanityURL string) ([]*VanityOwner, error) {
+	ctx, span := tracing.Start(ctx, "database.GetVanityOwners")
+	defer span.End()
+
+	scores, err := db.client.Do(ctx, db.client.B().Zrange().Key(db.vanityOwnersKey(vanityURL)).Min("+inf").Max("-inf").Byscore().Rev().Withscores().Build()).AsZScores()
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make([]*VanityOwner, 0, len(scores))
+	for _, score := range scores {
+		id, err := strconv.ParseInt(score.Member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		owners = append(owners, &VanityOwner{ID: id, LastSeen: time.Unix(int64(score.Score), 0).UTC()})
+	}
+
+	return owners, nil
+}
+
+// PreviousNames returns the distinct persona names the user had before the
+// current one, most recent first.
+func PreviousNames(aliases []*AliasEntry, current string) []string {
+	seen := map[string]bool{current: true}
+	var names []string
+	for i := len(aliases) - 1; i >= 0; i-- {
+		name := aliases[i].PersonaName
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	return names
+}
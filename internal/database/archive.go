@@ -0,0 +1,185 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+// idFromKey returns the SteamID at the end of a namespaced key.
+func idFromKey(key string) (int64, error) {
+	return strconv.ParseInt(key[strings.LastIndex(key, ":")+1:], 10, 64)
+}
+
+// EachUser calls fn for every stored user record.
+func (db *Database) EachUser(ctx context.Context, fn func(*User) error) error {
+	return db.scan(ctx, db.key("user", "*"), func(key string) error {
+		var user User
+		if err := db.client.Do(ctx, db.client.B().Get().Key(key).Build()).DecodeJSON(&user); err != nil {
+			if valkey.IsValkeyNil(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to read %q: %w", key, err)
+		}
+		upgradeUser(&user)
+
+		return fn(&user)
+	})
+}
+
+// EachHistory calls fn with the history of every user that has one.
+func (db *Database) EachHistory(ctx context.Context, fn func(id int64, entries []*HistoryEntry) error) error {
+	return db.scan(ctx, db.key("history", "*"), func(key string) error {
+		id, err := idFromKey(key)
+		if err != nil {
+			return nil
+		}
+
+		entries, err := db.GetHistory(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", key, err)
+		}
+
+		return fn(id, entries)
+	})
+}
+
+// EachAliases calls fn with the aliases of every user that has them.
+func (db *Database) EachAliases(ctx context.Context, fn func(id int64, entries []*AliasEntry) error) error {
+	return db.scan(ctx, db.key("aliases", "*"), func(key string) error {
+		id, err := idFromKey(key)
+		if err != nil {
+			return nil
+		}
+
+		entries, err := db.GetAliases(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", key, err)
+		}
+
+		return fn(id, entries)
+	})
+}
+
+// StoreBlob stores an image as a data URI under its hash, unless it already
+// exists. It's kept for the history retention.
+func (db *Database) StoreBlob(ctx context.Context, hash, data string) error {
+	ctx, span := tracing.Start(ctx, "database.StoreBlob")
+	defer span.End()
+
+	cmd := db.client.B().Set().Key(db.blobKey(hash)).Value(data).Nx().Build()
+	if db.retention > 0 {
+		cmd = db.client.B().Set().Key(db.blobKey(hash)).Value(data).Nx().Ex(db.retention).Build()
+	}
+	err := db.client.Do(ctx, cmd).Error()
+	if err != nil && !valkey.IsValkeyNil(err) {
+		return fmt.Errorf("failed to store image %s: %w", hash, err)
+	}
+
+	return nil
+}
+
+// ReplaceHistory overwrites the history of a user. The blobs of its entries
+// are kept as long as the history, so they must be stored first.
+func (db *Database) ReplaceHistory(ctx context.Context, id int64, entries []*HistoryEntry) error {
+	ctx, span := tracing.Start(ctx, "database.ReplaceHistory")
+	defer span.End()
+
+	key := db.historyKey(id)
+
+	cmds := valkey.Commands{db.client.B().Del().Key(key).Build()}
+	elements := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		elements = append(elements, valkey.JSON(entry))
+		cmds = append(cmds, db.client.B().Rpush().Key(key).Element(elements[len(elements)-1]).Build())
+	}
+	if db.retention > 0 {
+		for _, blob := range db.pastBlobKeys(elements) {
+			cmds = append(cmds, db.retainCmds(blob)...)
+		}
+	}
+
+	return db.exec(ctx, append(cmds, db.trimCmds(key)...))
+}
+
+// ReplaceAliases overwrites the aliases of a user and marks it as an owner of
+// every vanity URL it used.
+func (db *Database) ReplaceAliases(ctx context.Context, id int64, entries []*AliasEntry) error {
+	ctx, span := tracing.Start(ctx, "database.ReplaceAliases")
+	defer span.End()
+
+	key := db.aliasesKey(id)
+	member := strconv.FormatInt(id, 10)
+
+	cmds := valkey.Commands{db.client.B().Del().Key(key).Build()}
+	for _, entry := range entries {
+		cmds = append(cmds, db.client.B().Rpush().Key(key).Element(valkey.JSON(entry)).Build())
+		if entry.VanityURL != "" {
+			cmds = append(cmds, db.client.B().Zadd().Key(db.vanityOwnersKey(entry.VanityURL)).Gt().ScoreMember().ScoreMember(float64(entry.Timestamp.Unix()), member).Build())
+			cmds = append(cmds, db.retainCmds(db.vanityOwnersKey(entry.VanityURL))...)
+		}
+	}
+
+	return db.exec(ctx, append(cmds, db.trimCmds(key)...))
+}
+
+// trimCmds returns the commands applying the history limits to a list.
+func (db *Database) trimCmds(key string) valkey.Commands {
+	var cmds valkey.Commands
+	if db.maxHistory > 0 {
+		cmds = append(cmds, db.client.B().Ltrim().Key(key).Start(int64(-db.maxHistory)).Stop(-1).Build())
+	}
+
+	return append(cmds, db.retainCmds(key)...)
+}
+
+// retainCmds returns the command expiring a key after the history retention,
+// if there is one.
+func (db *Database) retainCmds(key string) valkey.Commands {
+	if db.retention <= 0 {
+		return nil
+	}
+
+	return valkey.Commands{db.client.B().Expire().Key(key).Seconds(int64(db.retention.Seconds())).Build()}
+}
+
+// RestoreUser stores an exported user as it was, expiring after ttl or the
+// default if it's zero, without recording history or aliases or calling the
+// change hooks.
+func (db *Database) RestoreUser(ctx context.Context, user *User, ttl time.Duration) error {
+	ctx, span := tracing.Start(ctx, "database.RestoreUser")
+	defer span.End()
+
+	if ttl <= 0 {
+		ttl = userTTL
+	}
+	upgradeUser(user)
+	id := strconv.FormatInt(user.ID, 10)
+
+	cmds := valkey.Commands{db.client.B().Set().Key(db.userKey(user.ID)).Value(valkey.JSON(user)).Px(ttl).Build()}
+	if user.VanityURL != "" {
+		cmds = append(cmds, db.client.B().Set().Key(db.vanityKey(user.VanityURL)).Value(id).Px(ttl).Build())
+	}
+	if err := db.exec(ctx, cmds); err != nil {
+		return fmt.Errorf("failed to restore user: %w", err)
+	}
+
+	return nil
+}
+
+// exec runs the commands in a MULTI/EXEC transaction.
+func (db *Database) exec(ctx context.Context, cmds valkey.Commands) error {
+	cmds = append(append(valkey.Commands{db.client.B().Multi().Build()}, cmds...), db.client.B().Exec().Build())
+	for _, resp := range db.client.DoMulti(ctx, cmds...) {
+		if err := resp.Error(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
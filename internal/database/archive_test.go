@@ -0,0 +1,59 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRestoreUser(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+	db.OnUserChange(func(ctx context.Context, before, after *User) {
+		t.Error("restoring a user called the change hooks")
+	})
+
+	changedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	user := testUser("a")
+	user.ChangedAt = changedAt
+	if err := db.RestoreUser(ctx, user, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := server.TTL(db.userKey(user.ID)); ttl != time.Hour {
+		t.Errorf("TTL = %v, want the exported 1h", ttl)
+	}
+	restored, err := db.GetUserByVanityURL(ctx, user.VanityURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.ChangedAt.Equal(changedAt) {
+		t.Errorf("ChangedAt = %v, want %v", restored.ChangedAt, changedAt)
+	}
+	for _, key := range []string{db.historyKey(user.ID), db.aliasesKey(user.ID), db.vanityOwnersKey(user.VanityURL)} {
+		if server.Exists(key) {
+			t.Errorf("restoring a user wrote %s", key)
+		}
+	}
+}
+
+func TestReplaceHistoryKeepsBlobs(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+	db.SetHistoryLimits(0, 24*time.Hour)
+
+	// Already stored by an earlier store, with less time left.
+	server.Set(db.blobKey("hash-a"), "data:image/png;base64,a")
+	server.SetTTL(db.blobKey("hash-a"), time.Hour)
+
+	entries := []*HistoryEntry{{Version: SchemaVersion, AvatarHash: "hash-a"}}
+	if err := db.ReplaceHistory(ctx, 76561197960287930, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{db.historyKey(76561197960287930), db.blobKey("hash-a")} {
+		if ttl := server.TTL(key); ttl != 24*time.Hour {
+			t.Errorf("TTL of %s = %v, want the 24h retention", key, ttl)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// UserChangeFunc is called after a user is stored with a different avatar or
+// frame than last recorded. It runs on the goroutine storing the user, so slow
+// work should be done in the background.
+type UserChangeFunc func(ctx context.Context, before, after *User)
+
+// OnUserChange registers fn to be called whenever a stored user changes its
+// avatar or frame. Changes are found against the last history entry, so they
+// are noticed after the record expired, but users seen for the first time are
+// not changes. It must be called before the database is used.
+func (db *Database) OnUserChange(fn UserChangeFunc) {
+	db.onChange = append(db.onChange, fn)
+}
+
+// notifyChange calls the change hooks.
+func (db *Database) notifyChange(ctx context.Context, before, after *User) {
+	for _, fn := range db.onChange {
+		fn(ctx, before, after)
+	}
+}
+
+// changedFrom returns the user as of its last history entry. The previous
+// record is used if it still has those images, as it has the URLs and item
+// names; otherwise the user is rebuilt from the entry.
+func changedFrom(id int64, previous string, entry *HistoryEntry) *User {
+	var user User
+	if previous != "" && json.Unmarshal([]byte(previous), &user) == nil {
+		upgradeUser(&user)
+		if entry.sameImages(&user) {
+			return &user
+		}
+	}
+
+	return &User{
+		Version:     SchemaVersion,
+		ID:          id,
+		DisplayName: entry.PersonaName,
+		AvatarHash:  entry.AvatarHash,
+		FrameHash:   entry.FrameHash,
+		FrameItemID: entry.FrameItemID,
+		FrameName:   entry.FrameName,
+		ChangedAt:   entry.Timestamp,
+	}
+}
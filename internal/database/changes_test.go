@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOnUserChange(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+
+	type change struct{ before, after *User }
+	var changes []change
+	db.OnUserChange(func(_ context.Context, before, after *User) {
+		changes = append(changes, change{before, after})
+	})
+
+	store := func(avatar string) {
+		t.Helper()
+		if err := db.CreateUser(ctx, testUser(avatar)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store("a")
+	store("a")
+	if len(changes) != 0 {
+		t.Fatalf("got %d changes for a new and an unchanged user, want none", len(changes))
+	}
+
+	store("b")
+	if len(changes) != 1 {
+		t.Fatalf("got %d changes, want 1", len(changes))
+	}
+	if before := changes[0].before; before.AvatarHash != "hash-a" || before.Avatar == "" {
+		t.Errorf("before = %+v, want the previous record with hash-a", before)
+	}
+	if after := changes[0].after; after.AvatarHash != "hash-b" {
+		t.Errorf("after has %s, want hash-b", after.AvatarHash)
+	}
+
+	// The record expires but the history is kept.
+	server.FastForward(userTTL + 1)
+	store("c")
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes after the record expired, want 2", len(changes))
+	}
+	before := changes[1].before
+	if before.AvatarHash != "hash-b" || before.ID != changes[1].after.ID || before.DisplayName != "Rabscuttle" {
+		t.Errorf("before = %+v, want the user with hash-b from its history", before)
+	}
+	if before.ChangedAt.IsZero() {
+		t.Error("before has no ChangedAt, want the time of the history entry")
+	}
+}
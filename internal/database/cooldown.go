@@ -0,0 +1,51 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+func (db *Database) refreshCooldownKey(id int64) string {
+	return db.key("refresh_cooldown", strconv.FormatInt(id, 10))
+}
+
+// startCooldown sets the key for ARGV[1] milliseconds unless it's already set.
+// It returns 0 if it was set, or the milliseconds left of the current cooldown.
+var startCooldown = valkey.NewLuaScript(`
+if redis.call('SET', KEYS[1], 1, 'NX', 'PX', ARGV[1]) then
+  return 0
+end
+return math.max(redis.call('PTTL', KEYS[1]), 1)
+`)
+
+// ClaimRefresh starts the cooldown between manual refreshes of a user. It
+// returns zero if the user can be refreshed, or how long until it can.
+func (db *Database) ClaimRefresh(ctx context.Context, id int64, cooldown time.Duration) (time.Duration, error) {
+	ctx, span := tracing.Start(ctx, "database.ClaimRefresh")
+	defer span.End()
+
+	left, err := startCooldown.Exec(ctx, db.client, []string{db.refreshCooldownKey(id)}, []string{fmt.Sprint(cooldown.Milliseconds())}).AsInt64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim refresh: %w", err)
+	}
+
+	return time.Duration(left) * time.Millisecond, nil
+}
+
+// ReleaseRefresh ends the cooldown of a user claimed by a refresh that failed,
+// so it can be tried again.
+func (db *Database) ReleaseRefresh(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "database.ReleaseRefresh")
+	defer span.End()
+
+	if err := db.client.Do(ctx, db.client.B().Del().Key(db.refreshCooldownKey(id)).Build()).Error(); err != nil {
+		return fmt.Errorf("failed to release refresh: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClaimRefresh(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+	const id, cooldown = 76561197960287930, time.Minute
+
+	claim := func(want time.Duration) {
+		t.Helper()
+		left, err := db.ClaimRefresh(ctx, id, cooldown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left != want {
+			t.Errorf("ClaimRefresh() = %v, want %v", left, want)
+		}
+	}
+
+	claim(0)
+	server.FastForward(10 * time.Second)
+	claim(50 * time.Second)
+
+	if err := db.ReleaseRefresh(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	claim(0)
+
+	server.FastForward(cooldown)
+	claim(0)
+}
@@ -1,6 +1,8 @@
 package database
 
 import (
+	"context"
+	"strings"
 	"time"
 
 	_ "github.com/glebarez/go-sqlite"
@@ -8,10 +10,14 @@ import (
 )
 
 type Database struct {
-	client valkey.Client
+	client     valkey.Client
+	prefix     string           // Prepended to every key so the instance can be shared
+	onChange   []UserChangeFunc // Called when a stored user changes its images
+	maxHistory int              // History and alias entries kept per user, 0 for unlimited
+	retention  time.Duration    // How long a history outlives the last store of its user, 0 for forever
 }
 
-func OpenDB(endpoint string) (*Database, error) {
+func OpenDB(endpoint, prefix string) (*Database, error) {
 	db, err := valkey.NewClient(valkey.ClientOption{
 		InitAddress:      []string{endpoint},
 		ConnWriteTimeout: 3 * time.Second,
@@ -21,9 +27,33 @@ func OpenDB(endpoint string) (*Database, error) {
 		return nil, err
 	}
 
-	return &Database{db}, nil
+	return New(db, prefix), nil
+}
+
+// New returns a database using an existing client.
+func New(client valkey.Client, prefix string) *Database {
+	return &Database{client: client, prefix: prefix}
+}
+
+// SetHistoryLimits bounds the history and aliases kept for each user, and how
+// long they and their images are kept once the user is no longer stored. It
+// must be called before the database is used.
+func (db *Database) SetHistoryLimits(maxEntries int, retention time.Duration) {
+	db.maxHistory = maxEntries
+	db.retention = retention
+}
+
+// Ping checks that the server is reachable.
+func (db *Database) Ping(ctx context.Context) error {
+	return db.client.Do(ctx, db.client.B().Ping().Build()).Error()
 }
 
 func (db *Database) Close() {
 	db.client.Close()
 }
+
+// key builds a namespaced key from its parts, e.g. key("user", "123") returns
+// "<prefix>user:123".
+func (db *Database) key(parts ...string) string {
+	return db.prefix + strings.Join(parts, ":")
+}
@@ -0,0 +1,27 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/valkey-io/valkey-go"
+)
+
+// newTestDB returns a database backed by an in-memory server, along with the
+// server so tests can inspect it and move its clock.
+func newTestDB(t *testing.T) (*Database, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client, err := valkey.NewClient(valkey.ClientOption{
+		InitAddress:       []string{server.Addr()},
+		DisableCache:      true, // Client side caching isn't supported
+		ForceSingleClient: true, // It answers CLUSTER commands
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	return New(client, "test:"), server
+}
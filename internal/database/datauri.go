@@ -0,0 +1,39 @@
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// DecodeDataURI splits a base64 data URI, the format images are stored in,
+// into its MIME type and content.
+func DecodeDataURI(uri string) (string, []byte, error) {
+	header, data, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid data URI")
+	}
+
+	content, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid data URI: %w", err)
+	}
+
+	return strings.TrimSuffix(header, ";base64"), content, nil
+}
+
+// FileExtension returns the file extension for an image MIME type.
+func FileExtension(mime string) string {
+	switch mime {
+	case "image/apng", "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ""
+	}
+}
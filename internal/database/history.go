@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+func (db *Database) historyKey(id int64) string {
+	return db.key("history", strconv.FormatInt(id, 10))
+}
+
+func (db *Database) blobKey(hash string) string {
+	return db.key("blob", hash)
+}
+
+func newHistoryEntry(user *User, now time.Time) HistoryEntry {
+	return HistoryEntry{
+		Version:     SchemaVersion,
+		Timestamp:   now,
+		AvatarHash:  user.AvatarHash,
+		FrameHash:   user.FrameHash,
+		FrameItemID: user.FrameItemID,
+		FrameName:   user.FrameName,
+		PersonaName: user.DisplayName,
+	}
+}
+
+// sameImages reports whether the user still has the images of the entry.
+func (e *HistoryEntry) sameImages(user *User) bool {
+	return e.AvatarHash == user.AvatarHash && e.FrameHash == user.FrameHash
+}
+
+// GetHistory returns the history of a user, oldest entry first.
+func (db *Database) GetHistory(ctx context.Context, id int64) ([]*HistoryEntry, error) {
+	ctx, span := tracing.Start(ctx, "database.GetHistory")
+	defer span.End()
+
+	var entries []*HistoryEntry
+
+	if err := valkey.DecodeSliceOfJSON(db.client.Do(ctx, db.client.B().Lrange().Key(db.historyKey(id)).Start(0).Stop(-1).Build()), &entries); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		upgradeHistoryEntry(entry)
+	}
+
+	return entries, nil
+}
+
+// HasHistory reports whether a user has been stored within the retention.
+func (db *Database) HasHistory(ctx context.Context, id int64) (bool, error) {
+	ctx, span := tracing.Start(ctx, "database.HasHistory")
+	defer span.End()
+
+	n, err := db.client.Do(ctx, db.client.B().Exists().Key(db.historyKey(id)).Build()).AsInt64()
+
+	return n > 0, err
+}
+
+// GetBlob returns a stored image as a data URI.
+func (db *Database) GetBlob(ctx context.Context, hash string) (string, error) {
+	ctx, span := tracing.Start(ctx, "database.GetBlob")
+	defer span.End()
+
+	return db.client.Do(ctx, db.client.B().Get().Key(db.blobKey(hash)).Build()).ToString()
+}
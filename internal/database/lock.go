@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+var renewLock = valkey.NewLuaScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseLock = valkey.NewLuaScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// AcquireLock takes the named lock for token if nobody holds it, or extends it
+// if token already does. It reports whether token holds the lock afterwards.
+func (db *Database) AcquireLock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	ctx, span := tracing.Start(ctx, "database.AcquireLock")
+	defer span.End()
+
+	key := db.key("lock", name)
+
+	renewed, err := renewLock.Exec(ctx, db.client, []string{key}, []string{token, fmt.Sprint(ttl.Milliseconds())}).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to renew lock %q: %w", name, err)
+	}
+	if renewed == 1 {
+		return true, nil
+	}
+
+	err = db.client.Do(ctx, db.client.B().Set().Key(key).Value(token).Nx().Px(ttl).Build()).Error()
+	if valkey.IsValkeyNil(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to acquire lock %q: %w", name, err)
+	}
+
+	return true, nil
+}
+
+// ReleaseLock releases the named lock if token holds it.
+func (db *Database) ReleaseLock(ctx context.Context, name, token string) error {
+	ctx, span := tracing.Start(ctx, "database.ReleaseLock")
+	defer span.End()
+
+	return releaseLock.Exec(ctx, db.client, []string{db.key("lock", name)}, []string{token}).Error()
+}
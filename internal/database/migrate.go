@@ -0,0 +1,251 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/steam"
+	"github.com/valkey-io/valkey-go"
+)
+
+// MigrationReport summarises the keys visited by Migrate.
+type MigrationReport struct {
+	Scanned  int `json:"scanned"`
+	Upgraded int `json:"upgraded"`
+	Legacy   int `json:"legacy"` // Unprefixed user records moved under the prefix
+}
+
+// Migrate rewrites every stored record to SchemaVersion. When legacy is set,
+// the bare SteamID and vanity URL keys written before keys were namespaced
+// are moved under the configured prefix as well.
+func (db *Database) Migrate(ctx context.Context, legacy bool) (*MigrationReport, error) {
+	report := &MigrationReport{}
+
+	if err := db.scan(ctx, db.key("user", "*"), func(key string) error {
+		report.Scanned++
+		upgraded, err := db.migrateUser(ctx, key)
+		if upgraded {
+			report.Upgraded++
+		}
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	if err := db.scan(ctx, db.key("history", "*"), func(key string) error {
+		report.Scanned++
+		upgraded, err := migrateList(ctx, db, key, upgradeHistoryEntry)
+		if upgraded {
+			report.Upgraded++
+		}
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	if err := db.scan(ctx, db.key("aliases", "*"), func(key string) error {
+		report.Scanned++
+		upgraded, err := migrateList(ctx, db, key, upgradeAliasEntry)
+		if upgraded {
+			report.Upgraded++
+		}
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	tokens, err := db.client.Do(ctx, db.client.B().Hkeys().Key(db.tokensKey()).Build()).AsStrSlice()
+	if err != nil {
+		return report, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	for _, id := range tokens {
+		report.Scanned++
+		upgraded, err := migrateField(ctx, db, db.tokensKey(), id, upgradeToken)
+		if upgraded {
+			report.Upgraded++
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if err := db.scan(ctx, db.key("webhook", "*"), func(key string) error {
+		report.Scanned++
+		upgraded, err := migrateField(ctx, db, key, "data", upgradeWebhook)
+		if upgraded {
+			report.Upgraded++
+		}
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	if !legacy {
+		return report, nil
+	}
+
+	// Every individual account SteamID starts with the same digits, which
+	// keeps the scan away from unrelated keys sharing the instance.
+	if err := db.scan(ctx, "7656119*", func(key string) error {
+		if !steam.IsSteamID(key) {
+			return nil
+		}
+		report.Scanned++
+		moved, err := db.migrateLegacyUser(ctx, key)
+		if moved {
+			report.Legacy++
+		}
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// scan calls fn for every key matching pattern.
+func (db *Database) scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	var cursor uint64
+	for {
+		entry, err := db.client.Do(ctx, db.client.B().Scan().Cursor(cursor).Match(pattern).Count(100).Build()).AsScanEntry()
+		if err != nil {
+			return fmt.Errorf("failed to scan %q: %w", pattern, err)
+		}
+
+		for _, key := range entry.Elements {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		if entry.Cursor == 0 {
+			return nil
+		}
+		cursor = entry.Cursor
+	}
+}
+
+func (db *Database) migrateUser(ctx context.Context, key string) (bool, error) {
+	var user User
+	if err := db.client.Do(ctx, db.client.B().Get().Key(key).Build()).DecodeJSON(&user); err != nil {
+		if valkey.IsValkeyNil(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read %q: %w", key, err)
+	}
+
+	if !upgradeUser(&user) {
+		return false, nil
+	}
+
+	if err := db.client.Do(ctx, db.client.B().Set().Key(key).Value(valkey.JSON(user)).Xx().Keepttl().Build()).Error(); err != nil && !valkey.IsValkeyNil(err) {
+		return false, fmt.Errorf("failed to write %q: %w", key, err)
+	}
+
+	return true, nil
+}
+
+// migrateList upgrades every entry of a list of JSON records in place.
+func migrateList[T any](ctx context.Context, db *Database, key string, upgrade func(*T) bool) (bool, error) {
+	elements, err := db.client.Do(ctx, db.client.B().Lrange().Key(key).Start(0).Stop(-1).Build()).AsStrSlice()
+	if err != nil {
+		return false, fmt.Errorf("failed to read %q: %w", key, err)
+	}
+
+	upgraded := false
+	for i, element := range elements {
+		var entry T
+		if err := json.Unmarshal([]byte(element), &entry); err != nil {
+			return upgraded, fmt.Errorf("failed to decode %q[%d]: %w", key, i, err)
+		}
+		if !upgrade(&entry) {
+			continue
+		}
+
+		if err := db.client.Do(ctx, db.client.B().Lset().Key(key).Index(int64(i)).Element(valkey.JSON(entry)).Build()).Error(); err != nil {
+			return upgraded, fmt.Errorf("failed to write %q[%d]: %w", key, i, err)
+		}
+		upgraded = true
+	}
+
+	return upgraded, nil
+}
+
+// replaceField sets a hash field only if it exists, so a record deleted while
+// it's migrated isn't brought back.
+var replaceField = valkey.NewLuaScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+  redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+end
+`)
+
+// migrateField upgrades a JSON record stored in a hash field in place. Fields
+// that disappear meanwhile are left alone.
+func migrateField[T any](ctx context.Context, db *Database, key, field string, upgrade func(*T) bool) (bool, error) {
+	var record T
+	if err := db.client.Do(ctx, db.client.B().Hget().Key(key).Field(field).Build()).DecodeJSON(&record); err != nil {
+		if valkey.IsValkeyNil(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read %q[%s]: %w", key, field, err)
+	}
+	if !upgrade(&record) {
+		return false, nil
+	}
+
+	if err := replaceField.Exec(ctx, db.client, []string{key}, []string{field, valkey.JSON(record)}).Error(); err != nil && !valkey.IsValkeyNil(err) {
+		return false, fmt.Errorf("failed to write %q[%s]: %w", key, field, err)
+	}
+
+	return true, nil
+}
+
+// migrateLegacyUser moves a user record stored under its bare SteamID, along
+// with the bare vanity URL key pointing to it, under the namespaced keys.
+func (db *Database) migrateLegacyUser(ctx context.Context, key string) (bool, error) {
+	var user User
+	if err := db.client.Do(ctx, db.client.B().Get().Key(key).Build()).DecodeJSON(&user); err != nil {
+		// Not a user record, leave it alone.
+		return false, nil
+	}
+	if strconv.FormatInt(user.ID, 10) != key {
+		return false, nil
+	}
+
+	ttl, err := db.client.Do(ctx, db.client.B().Pttl().Key(key).Build()).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to read TTL of %q: %w", key, err)
+	}
+	expiration := time.Duration(ttl) * time.Millisecond
+	if expiration <= 0 {
+		expiration = userTTL
+	}
+
+	legacyVanity := user.VanityURL
+	upgradeUser(&user)
+
+	// The change hooks are left alone, the user was stored before they were.
+	if _, err := db.storeUser(ctx, &user, expiration); err != nil {
+		return false, fmt.Errorf("failed to move %q: %w", key, err)
+	}
+
+	// The legacy vanity key was the raw search query, only remove it if it
+	// still points to this user.
+	if legacyVanity != "" && legacyVanity != key {
+		owner, err := db.client.Do(ctx, db.client.B().Get().Key(legacyVanity).Build()).ToString()
+		if err == nil && owner == key {
+			if err := db.client.Do(ctx, db.client.B().Del().Key(legacyVanity).Build()).Error(); err != nil {
+				return false, fmt.Errorf("failed to delete %q: %w", legacyVanity, err)
+			}
+		}
+	}
+
+	if err := db.client.Do(ctx, db.client.B().Del().Key(key).Build()).Error(); err != nil {
+		return false, fmt.Errorf("failed to delete %q: %w", key, err)
+	}
+
+	return true, nil
+}
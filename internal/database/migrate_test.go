@@ -0,0 +1,223 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"strings"
+	"testing"
+	"time"
+)
+
+const legacyID = "76561197960287930"
+
+// jpegDataURI returns a JPEG image labelled as a PNG, as avatars were stored
+// before the MIME type was read from them.
+func jpegDataURI(t *testing.T) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// storedUser decodes a stored user record as it is, without upgrading it.
+func storedUser(t *testing.T, value string) *User {
+	t.Helper()
+
+	var user User
+	if err := json.Unmarshal([]byte(value), &user); err != nil {
+		t.Fatal(err)
+	}
+
+	return &user
+}
+
+func TestMigrateTokensAndWebhooks(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+
+	server.HSet(db.tokensKey(), "abc", `{"id":"abc","name":"old"}`)
+	server.HSet(db.webhookKey("def"), "data", `{"id":"def","url":"https://example.com"}`, "failures", "0")
+
+	report, err := db.Migrate(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Upgraded != 2 {
+		t.Errorf("upgraded %d records, want 2", report.Upgraded)
+	}
+
+	for key, field := range map[string]string{db.tokensKey(): "abc", db.webhookKey("def"): "data"} {
+		var record struct {
+			Version int    `json:"v"`
+			ID      string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(server.HGet(key, field)), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Version != SchemaVersion || record.ID == "" {
+			t.Errorf("%s[%s] = %+v, want it at version %d", key, field, record, SchemaVersion)
+		}
+	}
+
+	if report, err := db.Migrate(ctx, false); err != nil || report.Upgraded != 0 {
+		t.Errorf("second migration upgraded %d records (%v), want none", report.Upgraded, err)
+	}
+}
+
+func TestMigrateUsers(t *testing.T) {
+	avatar := jpegDataURI(t)
+
+	tests := []struct {
+		name      string
+		stored    User
+		vanityURL string
+	}{
+		{
+			name:      "v0 vanity URL",
+			stored:    User{DisplayName: "Rabscuttle", VanityURL: "https://steamcommunity.com/id/GabeLoganNewell/", Avatar: avatar},
+			vanityURL: "gabelogannewell",
+		},
+		{
+			name:   "v0 SteamID as vanity URL",
+			stored: User{DisplayName: "Rabscuttle", VanityURL: legacyID, Avatar: avatar},
+		},
+		{
+			name:      "v1",
+			stored:    User{Version: 1, DisplayName: "Rabscuttle", VanityURL: "gabelogannewell", Avatar: avatar, AvatarHash: hashDataURI(avatar)},
+			vanityURL: "gabelogannewell",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, server := newTestDB(t)
+
+			tt.stored.ID = 76561197960287930
+			key := db.userKey(tt.stored.ID)
+			server.Set(key, mustJSON(t, tt.stored))
+			server.SetTTL(key, time.Hour)
+
+			report, err := db.Migrate(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Upgraded != 1 {
+				t.Errorf("upgraded %d records, want 1", report.Upgraded)
+			}
+
+			value, err := server.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := storedUser(t, value)
+			if user.Version != SchemaVersion {
+				t.Errorf("version = %d, want %d", user.Version, SchemaVersion)
+			}
+			if user.VanityURL != tt.vanityURL {
+				t.Errorf("vanity URL = %q, want %q", user.VanityURL, tt.vanityURL)
+			}
+			if user.AvatarHash != hashDataURI(avatar) {
+				t.Errorf("avatar hash = %q, want the hash of the avatar", user.AvatarHash)
+			}
+			if !strings.HasPrefix(user.Avatar, "data:image/jpeg;base64,") {
+				t.Errorf("avatar = %.30q..., want it relabelled as a JPEG", user.Avatar)
+			}
+			if user.AvatarMeta == nil || user.AvatarMeta.Width != 4 || user.AvatarMeta.Height != 2 {
+				t.Errorf("avatar meta = %+v, want a 4x2 image", user.AvatarMeta)
+			}
+			if ttl := server.TTL(key); ttl != time.Hour {
+				t.Errorf("TTL = %v, want the 1h it had", ttl)
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyUser(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+	db.SetHistoryLimits(10, 24*time.Hour)
+
+	avatar := jpegDataURI(t)
+	server.Set(legacyID, mustJSON(t, User{ID: 76561197960287930, DisplayName: "Rabscuttle", VanityURL: "GabeLoganNewell", Avatar: avatar}))
+	server.SetTTL(legacyID, time.Hour)
+	server.Set("GabeLoganNewell", legacyID)
+	// Keys sharing the instance that aren't user records are left alone.
+	server.Set("76561197960287931", "not a user")
+	server.Set("7656119", "short")
+
+	report, err := db.Migrate(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Legacy != 1 {
+		t.Errorf("moved %d legacy users, want 1", report.Legacy)
+	}
+
+	for _, key := range []string{legacyID, "GabeLoganNewell"} {
+		if server.Exists(key) {
+			t.Errorf("legacy key %s was kept", key)
+		}
+	}
+	for _, key := range []string{"76561197960287931", "7656119"} {
+		if !server.Exists(key) {
+			t.Errorf("unrelated key %s was removed", key)
+		}
+	}
+
+	user, err := db.GetUserByVanityURL(ctx, "gabelogannewell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Version != SchemaVersion || !strings.HasPrefix(user.Avatar, "data:image/jpeg;base64,") {
+		t.Errorf("moved user = v%d %.30q..., want it upgraded", user.Version, user.Avatar)
+	}
+
+	hash := hashDataURI(avatar)
+	for key, want := range map[string]time.Duration{
+		db.userKey(user.ID):                   time.Hour,
+		db.vanityKey("gabelogannewell"):       time.Hour,
+		db.historyKey(user.ID):                24 * time.Hour,
+		db.aliasesKey(user.ID):                24 * time.Hour,
+		db.vanityOwnersKey("gabelogannewell"): 24 * time.Hour,
+		db.blobKey(hash):                      24 * time.Hour,
+	} {
+		if ttl := server.TTL(key); ttl != want {
+			t.Errorf("TTL of %s = %v, want %v", key, ttl, want)
+		}
+	}
+
+	history, err := db.GetHistory(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].AvatarHash != hash {
+		t.Errorf("history = %+v, want one entry with the avatar", history)
+	}
+	aliases, err := db.GetAliases(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 || aliases[0].VanityURL != "gabelogannewell" {
+		t.Errorf("aliases = %+v, want one entry with the normalised vanity URL", aliases)
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
@@ -1,9 +1,98 @@
 package database
 
+import (
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/imagemeta"
+)
+
 type User struct {
-	ID          int64  `json:"id"` // Steam64 ID
-	DisplayName string `json:"display_name"`
-	VanityURL   string `json:"vanity_url"`
-	Avatar      string `json:"avatar"`
-	Frame       string `json:"frame"`
+	Version      int             `json:"v"`  // Schema version of the record
+	ID           int64           `json:"id"` // Steam64 ID
+	DisplayName  string          `json:"display_name"`
+	VanityURL    string          `json:"vanity_url"`
+	Avatar       string          `json:"avatar"`
+	AvatarHash   string          `json:"avatar_hash"` // SHA-256 of the avatar image
+	AvatarURL    string          `json:"avatar_url"`  // Where the avatar was downloaded from
+	AvatarItemID string          `json:"avatar_item_id"`
+	AvatarName   string          `json:"avatar_name"`
+	AvatarMeta   *imagemeta.Meta `json:"avatar_meta,omitempty"` // Read from the avatar image
+	Frame        string          `json:"frame"`
+	FrameHash    string          `json:"frame_hash"` // SHA-256 of the frame image
+	FrameURL     string          `json:"frame_url"`  // Where the frame was downloaded from
+	FrameItemID  string          `json:"frame_item_id"`
+	FrameName    string          `json:"frame_name"`
+	FrameMeta    *imagemeta.Meta `json:"frame_meta,omitempty"` // Read from the frame image
+	ChangedAt    time.Time       `json:"changed_at"`           // When the avatar or frame last changed, zero if unknown
+}
+
+// HistoryEntry is a snapshot of the images a user had equipped at a point in time.
+type HistoryEntry struct {
+	Version     int       `json:"v"` // Schema version of the record
+	Timestamp   time.Time `json:"timestamp"`
+	AvatarHash  string    `json:"avatar_hash"`
+	FrameHash   string    `json:"frame_hash"`
+	FrameItemID string    `json:"frame_item_id"`
+	FrameName   string    `json:"frame_name"`
+	PersonaName string    `json:"persona_name"`
+}
+
+// AliasEntry records the persona name and vanity URL a user had at a point in time.
+type AliasEntry struct {
+	Version     int       `json:"v"` // Schema version of the record
+	Timestamp   time.Time `json:"timestamp"`
+	PersonaName string    `json:"persona_name"`
+	VanityURL   string    `json:"vanity_url"`
+}
+
+// VanityOwner is a user that has used a vanity URL.
+type VanityOwner struct {
+	ID       int64     `json:"id"` // Steam64 ID
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Token grants an API client its own limits instead of the per address ones.
+type Token struct {
+	Version    int       `json:"v"` // Schema version of the record
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Hash       string    `json:"hash"` // SHA-256 of the secret, which isn't stored
+	Rate       float64   `json:"rate"` // Requests per second
+	Burst      int       `json:"burst"`
+	DailyQuota int64     `json:"daily_quota"`      // Requests per UTC day, 0 for unlimited
+	Routes     []string  `json:"routes,omitempty"` // Route patterns the token can use, all when empty
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TokenUsage counts the requests made with a token.
+type TokenUsage struct {
+	Today    int64     `json:"today"`
+	Total    int64     `json:"total"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Webhook notifies a URL when the subscribed users change their avatar or
+// frame.
+type Webhook struct {
+	Version    int       `json:"v"` // Schema version of the record
+	ID         string    `json:"id"`
+	TokenID    string    `json:"token_id"` // The token managing it
+	URL        string    `json:"url"`
+	SteamIDs   []int64   `json:"steam_ids"`
+	Secret     string    `json:"secret"` // Key of the HMAC signing the payloads
+	CreatedAt  time.Time `json:"created_at"`
+	Failures   int       `json:"-"` // Events failed in a row, stored apart from the rest
+	DisabledAt time.Time `json:"-"` // Set when disabled after too many failures
+}
+
+// WebhookDelivery records the delivery of an event to a webhook, retries
+// included.
+type WebhookDelivery struct {
+	ID         string    `json:"id"` // Of the event
+	Timestamp  time.Time `json:"timestamp"`
+	SteamID    int64     `json:"steam_id"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"` // Of the last attempt
+	Error      string    `json:"error,omitempty"`       // Of the last attempt
+	Success    bool      `json:"success"`
 }
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+// Request counts are kept in hourly buckets so popularity reflects the last
+// popularityWindow instead of growing forever.
+const (
+	popularityBucket = time.Hour
+	popularityWindow = 24 * time.Hour
+)
+
+func (db *Database) popularityKey(t time.Time) string {
+	return db.key("popularity", strconv.FormatInt(t.Unix()/int64(popularityBucket.Seconds()), 10))
+}
+
+// TrackRequest counts a request for the user.
+func (db *Database) TrackRequest(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "database.TrackRequest")
+	defer span.End()
+
+	key := db.popularityKey(time.Now())
+
+	for _, resp := range db.client.DoMulti(ctx,
+		db.client.B().Zincrby().Key(key).Increment(1).Member(strconv.FormatInt(id, 10)).Build(),
+		db.client.B().Expire().Key(key).Seconds(int64((popularityWindow + popularityBucket).Seconds())).Build(),
+	) {
+		if err := resp.Error(); err != nil {
+			return fmt.Errorf("failed to track request: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// PopularUsers returns the IDs of the n most requested users over the last
+// popularityWindow, most requested first.
+func (db *Database) PopularUsers(ctx context.Context, n int) ([]int64, error) {
+	ctx, span := tracing.Start(ctx, "database.PopularUsers")
+	defer span.End()
+
+	now := time.Now()
+	keys := make([]string, 0, int(popularityWindow/popularityBucket))
+	for t := now.Add(-popularityWindow + popularityBucket); !t.After(now); t = t.Add(popularityBucket) {
+		keys = append(keys, db.popularityKey(t))
+	}
+
+	// The union is only needed to read the top of it, so it expires along
+	// with the bucket it was built from.
+	dest := db.key("popularity", "top")
+	resps := db.client.DoMulti(ctx,
+		db.client.B().Zunionstore().Destination(dest).Numkeys(int64(len(keys))).Key(keys...).Build(),
+		db.client.B().Expire().Key(dest).Seconds(int64(popularityBucket.Seconds())).Build(),
+		db.client.B().Zrange().Key(dest).Min("0").Max(strconv.Itoa(n-1)).Rev().Build(),
+	)
+	if err := resps[0].Error(); err != nil {
+		return nil, fmt.Errorf("failed to aggregate popularity: %w", err)
+	}
+	members, err := resps[2].AsStrSlice()
+	if err != nil && !valkey.IsValkeyNil(err) {
+		return nil, fmt.Errorf("failed to get popular users: %w", err)
+	}
+
+	ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// UserTTL returns how long until the stored user record expires, or a
+// negative duration if there is no record.
+func (db *Database) UserTTL(ctx context.Context, id int64) (time.Duration, error) {
+	ctx, span := tracing.Start(ctx, "database.UserTTL")
+	defer span.End()
+
+	ttl, err := db.client.Do(ctx, db.client.B().Pttl().Key(db.userKey(id)).Build()).AsInt64()
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+// UserAge returns how long ago the stored user record was written.
+func (db *Database) UserAge(ctx context.Context, id int64) (time.Duration, error) {
+	ctx, span := tracing.Start(ctx, "database.UserAge")
+	defer span.End()
+
+	ttl, err := db.UserTTL(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, valkey.Nil
+	}
+
+	return userTTL - ttl, nil
+}
@@ -0,0 +1,30 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPopularUsers(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+
+	for id, requests := range map[int64]int{1: 1, 2: 3, 3: 2} {
+		for range requests {
+			if err := db.TrackRequest(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ids, err := db.PopularUsers(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Errorf("PopularUsers() = %v, want [2 3]", ids)
+	}
+	if ttl := server.TTL(db.key("popularity", "top")); ttl <= 0 || ttl > popularityBucket {
+		t.Errorf("TTL of the aggregate = %v, want up to %v", ttl, popularityBucket)
+	}
+}
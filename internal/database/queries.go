@@ -2,19 +2,114 @@ package database
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/mrmarble/steam-avatars/internal/metrics"
+	"github.com/mrmarble/steam-avatars/internal/tracing"
 	"github.com/valkey-io/valkey-go"
 )
 
-func (db *Database) GetUserByID(id int64) (*User, error) {
+const userTTL = time.Hour * 24
+
+func (db *Database) userKey(id int64) string {
+	return db.key("user", strconv.FormatInt(id, 10))
+}
+
+func (db *Database) vanityKey(vanityURL string) string {
+	return db.key("vanity", vanityURL)
+}
+
+// storeAttempts is how many times storing a user is tried when its history or
+// aliases change while it's being stored.
+const storeAttempts = 3
+
+// errConflict is returned by storeUser when the record, history or aliases it
+// was built from changed before it ran.
+var errConflict = errors.New("user changed while storing it")
+
+// storeUser writes the user record, its vanity URL mapping, the history and
+// alias entries and the images of the user at once. The entries are only
+// appended if the last ones are still those passed, and are trimmed to the
+// maximum, and the stale vanity URL mapping of the previous record is only
+// removed if that record is still the one passed and the mapping still points
+// to this user. The blobs of past history entries expire along with the
+// history, so the script refreshes them whenever it refreshes the list.
+//
+// KEYS: user, history, aliases, vanity, vanity owners, avatar blob, frame blob,
+// stale vanity, followed by the blobs of past history entries. The fourth to
+// eighth are empty when unused.
+//
+// ARGV: user JSON, SteamID, user TTL in milliseconds, previous user JSON, last
+// and new history entry, last and new alias entry, unix time, avatar, frame,
+// max entries, retention. New entries are empty when unchanged, and the limits
+// 0 when unbounded.
+var storeUser = valkey.NewLuaScript(`
+local max, retention = tonumber(ARGV[12]), tonumber(ARGV[13])
+local previous = redis.call('GET', KEYS[1]) or ''
+if previous ~= ARGV[4] or (redis.call('LINDEX', KEYS[2], -1) or '') ~= ARGV[5] or (redis.call('LINDEX', KEYS[3], -1) or '') ~= ARGV[7] then
+  return {'conflict'}
+end
+
+local ttl = tonumber(ARGV[3])
+if KEYS[8] ~= '' and redis.call('GET', KEYS[8]) == ARGV[2] then
+  redis.call('DEL', KEYS[8])
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl)
+if KEYS[4] ~= '' then
+  redis.call('SET', KEYS[4], ARGV[2], 'PX', ttl)
+  redis.call('ZADD', KEYS[5], ARGV[9], ARGV[2])
+end
+
+local function append(key, entry)
+  if entry ~= '' then
+    redis.call('RPUSH', key, entry)
+    if max > 0 then
+      redis.call('LTRIM', key, -max, -1)
+    end
+  end
+end
+append(KEYS[2], ARGV[6])
+append(KEYS[3], ARGV[8])
+
+for i, blob in ipairs({{KEYS[6], ARGV[10]}, {KEYS[7], ARGV[11]}}) do
+  if blob[1] ~= '' then
+    redis.call('SET', blob[1], blob[2], 'NX')
+  end
+end
+if retention > 0 then
+  for i = 2, 7 do
+    if KEYS[i] ~= '' and KEYS[i] ~= KEYS[4] then
+      redis.call('EXPIRE', KEYS[i], retention)
+    end
+  end
+  for i = 9, #KEYS do
+    redis.call('EXPIRE', KEYS[i], retention)
+  end
+end
+
+return {'ok'}
+`)
+
+func (db *Database) GetUserByID(ctx context.Context, id int64) (*User, error) {
+	ctx, span := tracing.Start(ctx, "database.GetUserByID")
+	defer span.End()
+
+	user, err := db.getUser(ctx, id)
+	countLookup(err)
+
+	return user, err
+}
+
+func (db *Database) getUser(ctx context.Context, id int64) (*User, error) {
 	var users []*User
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
 	defer cancel()
 
-	if err := valkey.DecodeSliceOfJSON(db.client.Do(ctx, db.client.B().Mget().Key(strconv.Itoa(int(id))).Build()), &users); err != nil {
+	if err := valkey.DecodeSliceOfJSON(db.client.Do(ctx, db.client.B().Mget().Key(db.userKey(id)).Build()), &users); err != nil {
 		return nil, err
 	}
 
@@ -22,13 +117,23 @@ func (db *Database) GetUserByID(id int64) (*User, error) {
 		return nil, valkey.Nil
 	}
 
-	return users[0], nil
+	user := users[0]
+	if upgradeUser(user) {
+		if err := db.client.Do(ctx, db.client.B().Set().Key(db.userKey(id)).Value(valkey.JSON(user)).Xx().Keepttl().Build()).Error(); err != nil && !valkey.IsValkeyNil(err) {
+			return nil, fmt.Errorf("failed to store upgraded user: %w", err)
+		}
+	}
+
+	return user, nil
 }
 
-func (db *Database) GetUserByVanityURL(vanity_url string) (*User, error) {
-	ctx := context.Background()
-	userID, err := db.client.Do(ctx, db.client.B().Get().Key(vanity_url).Build()).ToString()
+func (db *Database) GetUserByVanityURL(ctx context.Context, vanity_url string) (*User, error) {
+	ctx, span := tracing.Start(ctx, "database.GetUserByVanityURL")
+	defer span.End()
+
+	userID, err := db.client.Do(ctx, db.client.B().Get().Key(db.vanityKey(vanity_url)).Build()).ToString()
 	if err != nil {
+		countLookup(err)
 		return nil, err
 	}
 
@@ -37,18 +142,174 @@ func (db *Database) GetUserByVanityURL(vanity_url string) (*User, error) {
 		return nil, err
 	}
 
-	return db.GetUserByID(id)
+	user, err := db.getUser(ctx, id)
+	if valkey.IsValkeyNil(err) {
+		// The mapping outlived the user it points to.
+		metrics.CacheLookups.WithLabelValues("stale").Inc()
+	} else {
+		countLookup(err)
+	}
+
+	return user, err
 }
 
-func (db *Database) CreateUser(user *User) error {
-	ctx := context.Background()
-	// Store vanity URL to ID mapping
-	if err := db.client.Do(ctx, db.client.B().Set().Key(user.VanityURL).Value(strconv.Itoa(int(user.ID))).Ex(time.Hour*24).Build()).Error(); err != nil {
-		return fmt.Errorf("failed to store vanity URL to ID mapping: %w", err)
+// countLookup records the result of a user lookup.
+func countLookup(err error) {
+	switch {
+	case err == nil:
+		metrics.CacheLookups.WithLabelValues("hit").Inc()
+	case valkey.IsValkeyNil(err):
+		metrics.CacheLookups.WithLabelValues("miss").Inc()
 	}
-	if err := db.client.Do(ctx, db.client.B().Set().Key(strconv.Itoa(int(user.ID))).Value(valkey.JSON(user)).Ex(time.Hour*24).Build()).Error(); err != nil {
+}
+
+// CreateUser stores a user along with its history, aliases and images, setting
+// its ChangedAt. The change hooks are called if its images differ from those
+// of its last history entry, even if its record had expired.
+func (db *Database) CreateUser(ctx context.Context, user *User) error {
+	ctx, span := tracing.Start(ctx, "database.CreateUser")
+	defer span.End()
+
+	user.Version = SchemaVersion
+
+	before, err := db.storeUser(ctx, user, userTTL)
+	if err != nil {
 		return fmt.Errorf("failed to store user: %w", err)
 	}
+	if before != nil {
+		db.notifyChange(ctx, before, user)
+	}
 
 	return nil
 }
+
+// storeUser stores a user expiring after ttl, retrying while it conflicts. If
+// the images changed since the last history entry, it returns the user as it
+// was then.
+func (db *Database) storeUser(ctx context.Context, user *User, ttl time.Duration) (*User, error) {
+	for attempt := 1; ; attempt++ {
+		before, err := db.tryStoreUser(ctx, user, ttl)
+		if errors.Is(err, errConflict) && attempt < storeAttempts {
+			continue
+		}
+
+		return before, err
+	}
+}
+
+// tryStoreUser reads the stored record, history and last alias entry of a user
+// and stores it along with its new entries, if any. It returns errConflict if
+// any of them changed in between.
+func (db *Database) tryStoreUser(ctx context.Context, user *User, ttl time.Duration) (*User, error) {
+	now := time.Now().UTC()
+	historyKey, aliasesKey := db.historyKey(user.ID), db.aliasesKey(user.ID)
+
+	resps := db.client.DoMulti(ctx,
+		db.client.B().Lrange().Key(historyKey).Start(0).Stop(-1).Build(),
+		db.client.B().Lindex().Key(aliasesKey).Index(-1).Build(),
+		db.client.B().Get().Key(db.userKey(user.ID)).Build(),
+	)
+	history, err := resps[0].AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stored user: %w", err)
+	}
+	var last [3]string
+	if len(history) > 0 {
+		last[0] = history[len(history)-1]
+	}
+	for i, resp := range resps[1:] {
+		entry, err := resp.ToString()
+		if err != nil && !valkey.IsValkeyNil(err) {
+			return nil, fmt.Errorf("failed to read stored user: %w", err)
+		}
+		last[i+1] = entry
+	}
+
+	var newHistory, newAlias string
+	var before *User
+	var lastHistory HistoryEntry
+	hasHistory := last[0] != "" && json.Unmarshal([]byte(last[0]), &lastHistory) == nil
+	if hasHistory && lastHistory.sameImages(user) {
+		user.ChangedAt = lastHistory.Timestamp
+	} else {
+		newHistory = valkey.JSON(newHistoryEntry(user, now))
+		user.ChangedAt = now
+		if hasHistory {
+			upgradeHistoryEntry(&lastHistory)
+			before = changedFrom(user.ID, last[2], &lastHistory)
+		}
+	}
+	var lastAlias AliasEntry
+	if last[1] == "" || json.Unmarshal([]byte(last[1]), &lastAlias) != nil || !lastAlias.sameNames(user) {
+		newAlias = valkey.JSON(newAliasEntry(user, now))
+	}
+
+	keys := []string{db.userKey(user.ID), historyKey, aliasesKey, "", "", "", "", ""}
+	if user.VanityURL != "" {
+		keys[3], keys[4] = db.vanityKey(user.VanityURL), db.vanityOwnersKey(user.VanityURL)
+	}
+	if user.AvatarHash != "" {
+		keys[5] = db.blobKey(user.AvatarHash)
+	}
+	if user.FrameHash != "" {
+		keys[6] = db.blobKey(user.FrameHash)
+	}
+	// Every key a script touches must be passed to it, so the stale mapping
+	// is found here and the script checks the record it came from.
+	var previous struct {
+		VanityURL string `json:"vanity_url"`
+	}
+	if last[2] != "" && json.Unmarshal([]byte(last[2]), &previous) == nil && previous.VanityURL != "" && previous.VanityURL != user.VanityURL {
+		keys[7] = db.vanityKey(previous.VanityURL)
+	}
+	if db.retention > 0 {
+		keys = append(keys, db.pastBlobKeys(history, keys[5], keys[6])...)
+	}
+	args := []string{
+		valkey.JSON(user),
+		strconv.FormatInt(user.ID, 10),
+		strconv.FormatInt(ttl.Milliseconds(), 10),
+		last[2],
+		last[0], newHistory,
+		last[1], newAlias,
+		strconv.FormatInt(now.Unix(), 10),
+		user.Avatar, user.Frame,
+		strconv.Itoa(db.maxHistory),
+		strconv.Itoa(int(db.retention.Seconds())),
+	}
+
+	result, err := storeUser.Exec(ctx, db.client, keys, args).AsStrSlice()
+	if err != nil {
+		return nil, err
+	}
+	if result[0] == "conflict" {
+		return nil, errConflict
+	}
+
+	return before, nil
+}
+
+// pastBlobKeys returns the keys of the blobs referenced by history entries,
+// other than those skipped.
+func (db *Database) pastBlobKeys(history []string, skip ...string) []string {
+	seen := make(map[string]bool, len(skip))
+	for _, key := range skip {
+		seen[key] = true
+	}
+
+	var keys []string
+	for _, element := range history {
+		var entry HistoryEntry
+		if json.Unmarshal([]byte(element), &entry) != nil {
+			continue
+		}
+		for _, hash := range []string{entry.AvatarHash, entry.FrameHash} {
+			if key := db.blobKey(hash); hash != "" && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testUser(avatar string) *User {
+	return &User{
+		ID:          76561197960287930,
+		DisplayName: "Rabscuttle",
+		VanityURL:   "gabelogannewell",
+		Avatar:      "data:image/png;base64," + avatar,
+		AvatarHash:  "hash-" + avatar,
+	}
+}
+
+func TestCreateUserHistory(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+	db.SetHistoryLimits(2, 24*time.Hour)
+
+	first := testUser("a")
+	if err := db.CreateUser(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	same := testUser("a")
+	if err := db.CreateUser(ctx, same); err != nil {
+		t.Fatal(err)
+	}
+	if !same.ChangedAt.Equal(first.ChangedAt) {
+		t.Errorf("ChangedAt = %v, want %v from the first store", same.ChangedAt, first.ChangedAt)
+	}
+
+	for _, avatar := range []string{"b", "c"} {
+		if err := db.CreateUser(ctx, testUser(avatar)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := db.GetHistory(ctx, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, entry := range history {
+		hashes = append(hashes, entry.AvatarHash)
+	}
+	if len(hashes) != 2 || hashes[0] != "hash-b" || hashes[1] != "hash-c" {
+		t.Errorf("history = %v, want the last 2 changes [hash-b hash-c]", hashes)
+	}
+
+	aliases, err := db.GetAliases(ctx, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 {
+		t.Errorf("got %d alias entries, want 1", len(aliases))
+	}
+
+	for key, want := range map[string]time.Duration{
+		db.userKey(first.ID):                userTTL,
+		db.vanityKey(first.VanityURL):       userTTL,
+		db.historyKey(first.ID):             24 * time.Hour,
+		db.aliasesKey(first.ID):             24 * time.Hour,
+		db.vanityOwnersKey(first.VanityURL): 24 * time.Hour,
+		db.blobKey("hash-c"):                24 * time.Hour,
+	} {
+		if ttl := server.TTL(key); ttl != want {
+			t.Errorf("TTL of %s = %v, want %v", key, ttl, want)
+		}
+	}
+
+	server.FastForward(25 * time.Hour)
+	if _, err := db.GetBlob(ctx, "hash-a"); err == nil {
+		t.Error("blob of a past avatar outlived the retention")
+	}
+}
+
+func TestCreateUserKeepsPastBlobs(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+	db.SetHistoryLimits(0, 24*time.Hour)
+
+	for _, avatar := range []string{"a", "b", "b"} {
+		if err := db.CreateUser(ctx, testUser(avatar)); err != nil {
+			t.Fatal(err)
+		}
+		server.FastForward(20 * time.Hour)
+	}
+
+	// The history was refreshed by the last store, and with it every blob it
+	// points to.
+	if ttl := server.TTL(db.blobKey("hash-a")); ttl != 4*time.Hour {
+		t.Errorf("TTL of the blob of a past avatar = %v, want the 4h left to the history", ttl)
+	}
+}
+
+func TestCreateUserVanityURL(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestDB(t)
+
+	user := testUser("a")
+	if err := db.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	user.VanityURL = "rabscuttle"
+	if err := db.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.GetUserByVanityURL(ctx, "gabelogannewell"); err == nil {
+		t.Error("the previous vanity URL still points to the user")
+	}
+	found, err := db.GetUserByVanityURL(ctx, "rabscuttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != user.ID {
+		t.Errorf("vanity URL points to %d, want %d", found.ID, user.ID)
+	}
+}
+
+func TestCreateUserReassignedVanityURL(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestDB(t)
+
+	user := testUser("a")
+	if err := db.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	other := testUser("b")
+	other.ID++
+	if err := db.CreateUser(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	user.VanityURL = "rabscuttle"
+	if err := db.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.GetUserByVanityURL(ctx, other.VanityURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != other.ID {
+		t.Errorf("vanity URL points to %d, want its new owner %d", found.ID, other.ID)
+	}
+}
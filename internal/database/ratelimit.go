@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+// gcra implements the generic cell rate algorithm. The key holds the
+// theoretical arrival time of the next request in microseconds, taken from the
+// server clock so every replica agrees. ARGV is the emission interval in
+// microseconds and the burst. It returns whether the request is allowed, the
+// remaining requests, and the microseconds until a request is allowed and until
+// the bucket is full again.
+var gcra = valkey.NewLuaScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+  tat = now
+end
+
+local new_tat = tat + interval
+local diff = now - (new_tat - interval * burst)
+if diff < 0 then
+  return {0, 0, math.ceil(-diff), math.ceil(tat - now)}
+end
+
+redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor(diff / interval), 0, math.ceil(new_tat - now)}
+`)
+
+// RateLimit is the outcome of a rate limited request.
+type RateLimit struct {
+	Allowed    bool
+	Limit      int           // Requests allowed in a burst
+	Remaining  int           // Requests left in the current burst
+	RetryAfter time.Duration // Until the next request is allowed, when denied
+	Reset      time.Duration // Until the full burst is available again
+}
+
+// AllowRequest counts a request against the limit of id in the named bucket,
+// which allows rate requests per second with bursts of burst requests. The
+// limit is shared by every replica.
+func (db *Database) AllowRequest(ctx context.Context, bucket, id string, rate float64, burst int) (*RateLimit, error) {
+	ctx, span := tracing.Start(ctx, "database.AllowRequest")
+	defer span.End()
+
+	interval := int64(math.Round(float64(time.Second/time.Microsecond) / rate))
+	res, err := gcra.Exec(ctx, db.client, []string{db.key("ratelimit", bucket, id)}, []string{fmt.Sprint(interval), fmt.Sprint(burst)}).ToArray()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check rate limit: %w", err)
+	}
+
+	values := make([]int64, len(res))
+	for i, v := range res {
+		if values[i], err = v.AsInt64(); err != nil {
+			return nil, fmt.Errorf("failed to check rate limit: %w", err)
+		}
+	}
+
+	return &RateLimit{
+		Allowed:    values[0] == 1,
+		Limit:      burst,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		Reset:      time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
+
+// RateLimiterStore is an echo middleware.RateLimiterStore keeping the limits in
+// Valkey.
+type RateLimiterStore struct {
+	db     *Database
+	bucket string
+	rate   float64
+	burst  int
+}
+
+func (db *Database) RateLimiterStore(bucket string, rate float64, burst int) *RateLimiterStore {
+	return &RateLimiterStore{db: db, bucket: bucket, rate: rate, burst: burst}
+}
+
+// Allow implements middleware.RateLimiterStore.
+func (s *RateLimiterStore) Allow(identifier string) (bool, error) {
+	limit, err := s.Check(context.Background(), identifier)
+	if err != nil {
+		return false, err
+	}
+
+	return limit.Allowed, nil
+}
+
+// Check counts a request of identifier and returns the details of its limit.
+func (s *RateLimiterStore) Check(ctx context.Context, identifier string) (*RateLimit, error) {
+	return s.db.AllowRequest(ctx, s.bucket, identifier, s.rate, s.burst)
+}
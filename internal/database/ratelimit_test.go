@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAllowRequest(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// One request per second with bursts of 3.
+	for i, step := range []struct {
+		at         time.Duration // Since start
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}{
+		{0, true, 2, 0, time.Second},
+		{0, true, 1, 0, 2 * time.Second},
+		{0, true, 0, 0, 3 * time.Second},
+		{0, false, 0, time.Second, 3 * time.Second},
+		{500 * time.Millisecond, false, 0, 500 * time.Millisecond, 2500 * time.Millisecond},
+		{time.Second, true, 0, 0, 3 * time.Second},
+		{time.Second, false, 0, time.Second, 3 * time.Second},
+		{10 * time.Second, true, 2, 0, time.Second},
+	} {
+		server.SetTime(start.Add(step.at))
+
+		limit, err := db.AllowRequest(ctx, "test", "client", 1, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := RateLimit{Allowed: step.allowed, Limit: 3, Remaining: step.remaining, RetryAfter: step.retryAfter, Reset: step.reset}
+		if *limit != want {
+			t.Errorf("request %d at +%v = %+v, want %+v", i+1, step.at, *limit, want)
+		}
+	}
+}
+
+func TestAllowRequestSeparateClients(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestDB(t)
+
+	for _, id := range []string{"a", "b"} {
+		limit, err := db.AllowRequest(ctx, "test", id, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !limit.Allowed {
+			t.Errorf("first request of %s denied", id)
+		}
+	}
+	limit, err := db.AllowRequest(ctx, "other", "a", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !limit.Allowed {
+		t.Error("first request in another bucket denied")
+	}
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/mrmarble/steam-avatars/internal/imagemeta"
+	"github.com/mrmarble/steam-avatars/internal/steam"
+)
+
+// SchemaVersion is the version of the records written by this build. When the
+// shape of a stored record changes, bump it and append an upgrade step below.
+//
+// Users, history and alias entries, tokens and webhooks are versioned, as they
+// are JSON records that outlive a deploy. The other keys aren't: images are
+// data URIs stored by the hash of their content and never rewritten, vanity
+// URL mappings, owners, subscriptions and counters hold bare IDs and numbers,
+// cooldowns, rate limits, locks and popularity scores expire or are rebuilt
+// within hours, and the delivery logs of webhooks are capped and only read
+// back as they were written, missing fields left empty.
+const SchemaVersion = 2
+
+// userUpgrades[n] upgrades a user record from version n to n+1.
+var userUpgrades = []func(*User){
+	upgradeUserV1,
+	upgradeUserV2,
+}
+
+// upgradeUser brings a user record up to SchemaVersion, reporting whether it
+// was modified.
+func upgradeUser(user *User) bool {
+	if user.Version >= SchemaVersion {
+		return false
+	}
+
+	for v := user.Version; v < SchemaVersion; v++ {
+		userUpgrades[v](user)
+	}
+	user.Version = SchemaVersion
+
+	return true
+}
+
+// upgradeUserV1 fills in the image hashes and normalises the vanity URL of
+// records written before they were tracked.
+func upgradeUserV1(user *User) {
+	if user.AvatarHash == "" {
+		user.AvatarHash = hashDataURI(user.Avatar)
+	}
+	if user.FrameHash == "" {
+		user.FrameHash = hashDataURI(user.Frame)
+	}
+
+	user.VanityURL = steam.NormalizeQuery(user.VanityURL)
+	if steam.IsSteamID(user.VanityURL) {
+		user.VanityURL = ""
+	}
+}
+
+// upgradeUserV2 reads the metadata of the images and relabels the data URIs
+// with their real MIME type, as frames were always stored as APNG and avatars
+// as PNG.
+func upgradeUserV2(user *User) {
+	user.Avatar, user.AvatarMeta = relabelDataURI(user.Avatar)
+	user.Frame, user.FrameMeta = relabelDataURI(user.Frame)
+}
+
+// upgradeHistoryEntry brings a history entry up to SchemaVersion, reporting
+// whether it was modified. Its shape has not changed since it was introduced.
+// The blobs it points to keep the MIME type they were stored with.
+func upgradeHistoryEntry(entry *HistoryEntry) bool {
+	if entry.Version >= SchemaVersion {
+		return false
+	}
+	entry.Version = SchemaVersion
+
+	return true
+}
+
+// upgradeAliasEntry brings an alias entry up to SchemaVersion, reporting
+// whether it was modified. Its shape has not changed since it was introduced.
+func upgradeAliasEntry(entry *AliasEntry) bool {
+	if entry.Version >= SchemaVersion {
+		return false
+	}
+	entry.Version = SchemaVersion
+
+	return true
+}
+
+// upgradeToken brings a token up to SchemaVersion, reporting whether it was
+// modified. Its shape has not changed since it was introduced.
+func upgradeToken(token *Token) bool {
+	if token.Version >= SchemaVersion {
+		return false
+	}
+	token.Version = SchemaVersion
+
+	return true
+}
+
+// upgradeWebhook brings a webhook up to SchemaVersion, reporting whether it was
+// modified. Its shape has not changed since it was introduced.
+func upgradeWebhook(hook *Webhook) bool {
+	if hook.Version >= SchemaVersion {
+		return false
+	}
+	hook.Version = SchemaVersion
+
+	return true
+}
+
+// hashDataURI returns the SHA-256 of the content of a base64 data URI, or an
+// empty string if it can't be decoded.
+func hashDataURI(uri string) string {
+	_, content, err := DecodeDataURI(uri)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// relabelDataURI returns the data URI with the MIME type read from its content,
+// and the metadata of the image. Data URIs that can't be read are returned as
+// they are.
+func relabelDataURI(uri string) (string, *imagemeta.Meta) {
+	mime, content, err := DecodeDataURI(uri)
+	if err != nil {
+		return uri, nil
+	}
+	meta, err := imagemeta.Read(content)
+	if err != nil {
+		return uri, nil
+	}
+	if meta.MIME == mime {
+		return uri, meta
+	}
+
+	return "data:" + meta.MIME + ";base64," + uri[strings.Index(uri, ",")+1:], meta
+}
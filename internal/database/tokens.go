@@ -0,0 +1,207 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+const tokenPrefix = "sat_"
+
+// ErrInvalidToken is returned for secrets that don't belong to a token.
+var ErrInvalidToken = errors.New("invalid token")
+
+func (db *Database) tokensKey() string {
+	return db.key("tokens")
+}
+
+func (db *Database) tokenUsageKey(id string) string {
+	return db.key("token_usage", id)
+}
+
+func (db *Database) tokenDailyUsageKey(id string, day time.Time) string {
+	return db.key("token_usage", id, day.Format(time.DateOnly))
+}
+
+// CreateToken stores a new token and returns its secret, which is the only
+// time it is available. The ID, hash and creation time are set on token.
+func (db *Database) CreateToken(ctx context.Context, token *Token) (string, error) {
+	ctx, span := tracing.Start(ctx, "database.CreateToken")
+	defer span.End()
+
+	id := make([]byte, 6)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	// The ID is part of the secret so a token is found without an index.
+	token.Version = SchemaVersion
+	token.ID = hex.EncodeToString(id)
+	token.CreatedAt = time.Now().UTC()
+	value := tokenPrefix + token.ID + "_" + hex.EncodeToString(secret)
+	token.Hash = hashSecret(value)
+
+	created, err := db.client.Do(ctx, db.client.B().Hsetnx().Key(db.tokensKey()).Field(token.ID).Value(valkey.JSON(token)).Build()).AsBool()
+	if err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	if !created {
+		return "", fmt.Errorf("token %q already exists", token.ID)
+	}
+
+	return value, nil
+}
+
+// GetToken returns the token a secret belongs to, or ErrInvalidToken.
+func (db *Database) GetToken(ctx context.Context, secret string) (*Token, error) {
+	ctx, span := tracing.Start(ctx, "database.GetToken")
+	defer span.End()
+
+	id, _, ok := strings.Cut(strings.TrimPrefix(secret, tokenPrefix), "_")
+	if !ok || !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+
+	var token Token
+	err := db.client.Do(ctx, db.client.B().Hget().Key(db.tokensKey()).Field(id).Build()).DecodeJSON(&token)
+	if valkey.IsValkeyNil(err) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidToken
+	}
+	upgradeToken(&token)
+
+	return &token, nil
+}
+
+// ListTokens returns every token, oldest first.
+func (db *Database) ListTokens(ctx context.Context) ([]*Token, error) {
+	ctx, span := tracing.Start(ctx, "database.ListTokens")
+	defer span.End()
+
+	values, err := db.client.Do(ctx, db.client.B().Hvals().Key(db.tokensKey()).Build()).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	tokens := make([]*Token, 0, len(values))
+	for _, value := range values {
+		var token Token
+		if err := json.Unmarshal([]byte(value), &token); err != nil {
+			return nil, err
+		}
+		upgradeToken(&token)
+		tokens = append(tokens, &token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+
+	return tokens, nil
+}
+
+// DeleteToken revokes a token and drops its usage counters and its webhooks,
+// so they aren't delivered to anymore. It reports whether the token existed.
+func (db *Database) DeleteToken(ctx context.Context, id string) (bool, error) {
+	ctx, span := tracing.Start(ctx, "database.DeleteToken")
+	defer span.End()
+
+	exists, err := db.client.Do(ctx, db.client.B().Hexists().Key(db.tokensKey()).Field(id).Build()).AsBool()
+	if err != nil {
+		return false, fmt.Errorf("failed to get token: %w", err)
+	}
+	hooks, err := db.ListWebhooks(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	cmds := valkey.Commands{
+		db.client.B().Hdel().Key(db.tokensKey()).Field(id).Build(),
+		db.client.B().Del().Key(db.tokenUsageKey(id), db.tokenDailyUsageKey(id, time.Now().UTC()), db.tokenWebhooksKey(id)).Build(),
+	}
+	for _, hook := range hooks {
+		cmds = append(cmds, db.deleteWebhookCmds(hook)...)
+	}
+	if err := db.exec(ctx, cmds); err != nil {
+		return false, fmt.Errorf("failed to delete token: %w", err)
+	}
+
+	return exists, nil
+}
+
+// CountTokenUsage records a request made with the token and returns the
+// number of requests it made today, this one included.
+func (db *Database) CountTokenUsage(ctx context.Context, id string) (int64, error) {
+	ctx, span := tracing.Start(ctx, "database.CountTokenUsage")
+	defer span.End()
+
+	now := time.Now().UTC()
+	daily := db.tokenDailyUsageKey(id, now)
+
+	res := db.client.DoMulti(ctx,
+		db.client.B().Incr().Key(daily).Build(),
+		// Kept past the end of the day so today's count can still be read.
+		db.client.B().Expire().Key(daily).Seconds(int64((48 * time.Hour).Seconds())).Build(),
+		db.client.B().Hincrby().Key(db.tokenUsageKey(id)).Field("total").Increment(1).Build(),
+		db.client.B().Hset().Key(db.tokenUsageKey(id)).FieldValue().FieldValue("last_used", strconv.FormatInt(now.Unix(), 10)).Build(),
+	)
+	for _, r := range res {
+		if err := r.Error(); err != nil {
+			return 0, fmt.Errorf("failed to count token usage: %w", err)
+		}
+	}
+
+	return res[0].AsInt64()
+}
+
+// GetTokenUsage returns the usage counters of a token.
+func (db *Database) GetTokenUsage(ctx context.Context, id string) (*TokenUsage, error) {
+	ctx, span := tracing.Start(ctx, "database.GetTokenUsage")
+	defer span.End()
+
+	res := db.client.DoMulti(ctx,
+		db.client.B().Get().Key(db.tokenDailyUsageKey(id, time.Now().UTC())).Build(),
+		db.client.B().Hgetall().Key(db.tokenUsageKey(id)).Build(),
+	)
+
+	var usage TokenUsage
+	today, err := res[0].AsInt64()
+	if err != nil && !valkey.IsValkeyNil(err) {
+		return nil, fmt.Errorf("failed to get token usage: %w", err)
+	}
+	usage.Today = today
+
+	fields, err := res[1].AsStrMap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token usage: %w", err)
+	}
+	usage.Total, _ = strconv.ParseInt(fields["total"], 10, 64)
+	if lastUsed, err := strconv.ParseInt(fields["last_used"], 10, 64); err == nil {
+		usage.LastUsed = time.Unix(lastUsed, 0).UTC()
+	}
+
+	return &usage, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
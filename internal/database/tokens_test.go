@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeleteToken(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+
+	token := &Token{Name: "test"}
+	secret, err := db.CreateToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CountTokenUsage(ctx, token.ID); err != nil {
+		t.Fatal(err)
+	}
+	hook := &Webhook{TokenID: token.ID, URL: "https://example.com/hook", SteamIDs: []int64{76561197960287930}}
+	if err := db.CreateWebhook(ctx, hook); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RecordDelivery(ctx, hook.ID, &WebhookDelivery{ID: "event", Success: true}, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := db.DeleteToken(ctx, token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted {
+		t.Error("DeleteToken() = false, want true for an existing token")
+	}
+
+	if _, err := db.GetToken(ctx, secret); err != ErrInvalidToken {
+		t.Errorf("GetToken() error = %v, want ErrInvalidToken", err)
+	}
+	subscribers, err := db.Subscribers(ctx, 76561197960287930)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscribers) != 0 {
+		t.Errorf("got %d subscribers, want the webhook of the token gone", len(subscribers))
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("keys left behind: %v", keys)
+	}
+
+	if deleted, err := db.DeleteToken(ctx, token.ID); err != nil || deleted {
+		t.Errorf("DeleteToken() = %v, %v again, want false", deleted, err)
+	}
+}
@@ -0,0 +1,275 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/valkey-io/valkey-go"
+)
+
+// maxDeliveries is how many deliveries are kept in the log of a webhook.
+const maxDeliveries = 50
+
+// A webhook is a hash with its JSON under "data", apart from its failure count
+// and when it was disabled, which are updated on their own.
+func (db *Database) webhookKey(id string) string {
+	return db.key("webhook", id)
+}
+
+func (db *Database) tokenWebhooksKey(tokenID string) string {
+	return db.key("token_webhooks", tokenID)
+}
+
+func (db *Database) webhookSubscribersKey(steamID int64) string {
+	return db.key("webhook_subscribers", strconv.FormatInt(steamID, 10))
+}
+
+func (db *Database) webhookDeliveriesKey(id string) string {
+	return db.key("webhook_deliveries", id)
+}
+
+// CreateWebhook stores a new webhook. The ID, secret and creation time are set
+// on hook.
+func (db *Database) CreateWebhook(ctx context.Context, hook *Webhook) error {
+	ctx, span := tracing.Start(ctx, "database.CreateWebhook")
+	defer span.End()
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	hook.Version = SchemaVersion
+	hook.ID = hex.EncodeToString(id)
+	hook.Secret = hex.EncodeToString(secret)
+	hook.CreatedAt = time.Now().UTC()
+
+	cmds := valkey.Commands{
+		db.client.B().Hset().Key(db.webhookKey(hook.ID)).FieldValue().FieldValue("data", valkey.JSON(hook)).FieldValue("failures", "0").Build(),
+		db.client.B().Sadd().Key(db.tokenWebhooksKey(hook.TokenID)).Member(hook.ID).Build(),
+	}
+	for _, steamID := range hook.SteamIDs {
+		cmds = append(cmds, db.client.B().Sadd().Key(db.webhookSubscribersKey(steamID)).Member(hook.ID).Build())
+	}
+	if err := db.exec(ctx, cmds); err != nil {
+		return fmt.Errorf("failed to store webhook: %w", err)
+	}
+
+	return nil
+}
+
+// GetWebhook returns a webhook, or valkey.Nil if there is none.
+func (db *Database) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	ctx, span := tracing.Start(ctx, "database.GetWebhook")
+	defer span.End()
+
+	fields, err := db.client.Do(ctx, db.client.B().Hgetall().Key(db.webhookKey(id)).Build()).AsStrMap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook: %w", err)
+	}
+	if fields["data"] == "" {
+		return nil, valkey.Nil
+	}
+
+	var hook Webhook
+	if err := json.Unmarshal([]byte(fields["data"]), &hook); err != nil {
+		return nil, err
+	}
+	upgradeWebhook(&hook)
+	hook.Failures, _ = strconv.Atoi(fields["failures"])
+	if disabledAt, err := strconv.ParseInt(fields["disabled_at"], 10, 64); err == nil {
+		hook.DisabledAt = time.Unix(disabledAt, 0).UTC()
+	}
+
+	return &hook, nil
+}
+
+// ListWebhooks returns the webhooks of a token, oldest first.
+func (db *Database) ListWebhooks(ctx context.Context, tokenID string) ([]*Webhook, error) {
+	ctx, span := tracing.Start(ctx, "database.ListWebhooks")
+	defer span.End()
+
+	ids, err := db.client.Do(ctx, db.client.B().Smembers().Key(db.tokenWebhooksKey(tokenID)).Build()).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+
+	hooks, err := db.getWebhooks(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+
+	return hooks, nil
+}
+
+// Subscribers returns the enabled webhooks subscribed to a user.
+func (db *Database) Subscribers(ctx context.Context, steamID int64) ([]*Webhook, error) {
+	ctx, span := tracing.Start(ctx, "database.Subscribers")
+	defer span.End()
+
+	ids, err := db.client.Do(ctx, db.client.B().Smembers().Key(db.webhookSubscribersKey(steamID)).Build()).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscribers: %w", err)
+	}
+
+	hooks, err := db.getWebhooks(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	enabled := hooks[:0]
+	for _, hook := range hooks {
+		if hook.DisabledAt.IsZero() {
+			enabled = append(enabled, hook)
+		}
+	}
+
+	return enabled, nil
+}
+
+// SubscribedUsers returns the IDs of the users with webhooks subscribed to
+// them. The subscriptions are scanned, as there are far fewer of them than
+// users.
+func (db *Database) SubscribedUsers(ctx context.Context) ([]int64, error) {
+	ctx, span := tracing.Start(ctx, "database.SubscribedUsers")
+	defer span.End()
+
+	var ids []int64
+	err := db.scan(ctx, db.key("webhook_subscribers", "*"), func(key string) error {
+		id, err := idFromKey(key)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+
+	return ids, err
+}
+
+// getWebhooks returns the webhooks that still exist out of ids.
+func (db *Database) getWebhooks(ctx context.Context, ids []string) ([]*Webhook, error) {
+	hooks := make([]*Webhook, 0, len(ids))
+	for _, id := range ids {
+		hook, err := db.GetWebhook(ctx, id)
+		if valkey.IsValkeyNil(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook removes a webhook, its subscriptions and its delivery log.
+func (db *Database) DeleteWebhook(ctx context.Context, hook *Webhook) error {
+	ctx, span := tracing.Start(ctx, "database.DeleteWebhook")
+	defer span.End()
+
+	if err := db.exec(ctx, db.deleteWebhookCmds(hook)); err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+
+	return nil
+}
+
+// deleteWebhookCmds returns the commands removing a webhook, its subscriptions
+// and its delivery log.
+func (db *Database) deleteWebhookCmds(hook *Webhook) valkey.Commands {
+	cmds := valkey.Commands{
+		db.client.B().Del().Key(db.webhookKey(hook.ID), db.webhookDeliveriesKey(hook.ID)).Build(),
+		db.client.B().Srem().Key(db.tokenWebhooksKey(hook.TokenID)).Member(hook.ID).Build(),
+	}
+	for _, steamID := range hook.SteamIDs {
+		cmds = append(cmds, db.client.B().Srem().Key(db.webhookSubscribersKey(steamID)).Member(hook.ID).Build())
+	}
+
+	return cmds
+}
+
+// EnableWebhook enables a disabled webhook and resets its failures.
+func (db *Database) EnableWebhook(ctx context.Context, id string) error {
+	ctx, span := tracing.Start(ctx, "database.EnableWebhook")
+	defer span.End()
+
+	err := db.exec(ctx, valkey.Commands{
+		db.client.B().Hdel().Key(db.webhookKey(id)).Field("disabled_at").Build(),
+		db.client.B().Hset().Key(db.webhookKey(id)).FieldValue().FieldValue("failures", "0").Build(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable webhook: %w", err)
+	}
+
+	return nil
+}
+
+// recordDelivery adds a delivery to the log of a webhook and counts its
+// failures in a row, disabling it once they reach the limit. Only webhooks
+// that still exist are updated, so a delivery finishing after a deletion
+// doesn't bring back its log. It returns 1 if it disabled the webhook.
+//
+// KEYS: webhook, deliveries. ARGV: delivery JSON, log length, "1" for a
+// success, failures before disabling, unix time.
+var recordDelivery = valkey.NewLuaScript(`
+if redis.call('HEXISTS', KEYS[1], 'data') == 0 then
+  return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+redis.call('LTRIM', KEYS[2], 0, tonumber(ARGV[2]) - 1)
+
+if ARGV[3] == '1' then
+  redis.call('HSET', KEYS[1], 'failures', 0)
+  return 0
+end
+if redis.call('HINCRBY', KEYS[1], 'failures', 1) < tonumber(ARGV[4]) then
+  return 0
+end
+return redis.call('HSETNX', KEYS[1], 'disabled_at', ARGV[5])
+`)
+
+// RecordDelivery adds a delivery to the log of a webhook and counts its
+// failures in a row, disabling the webhook once they reach disableAfter. It
+// reports whether the webhook was disabled by this delivery.
+func (db *Database) RecordDelivery(ctx context.Context, id string, delivery *WebhookDelivery, disableAfter int) (bool, error) {
+	ctx, span := tracing.Start(ctx, "database.RecordDelivery")
+	defer span.End()
+
+	success := "0"
+	if delivery.Success {
+		success = "1"
+	}
+	disabled, err := recordDelivery.Exec(ctx, db.client,
+		[]string{db.webhookKey(id), db.webhookDeliveriesKey(id)},
+		[]string{valkey.JSON(delivery), strconv.Itoa(maxDeliveries), success, strconv.Itoa(disableAfter), strconv.FormatInt(time.Now().Unix(), 10)},
+	).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to record delivery: %w", err)
+	}
+
+	return disabled == 1, nil
+}
+
+// GetDeliveries returns the delivery log of a webhook, newest first.
+func (db *Database) GetDeliveries(ctx context.Context, id string) ([]*WebhookDelivery, error) {
+	ctx, span := tracing.Start(ctx, "database.GetDeliveries")
+	defer span.End()
+
+	var deliveries []*WebhookDelivery
+	if err := valkey.DecodeSliceOfJSON(db.client.Do(ctx, db.client.B().Lrange().Key(db.webhookDeliveriesKey(id)).Start(0).Stop(-1).Build()), &deliveries); err != nil {
+		return nil, fmt.Errorf("failed to get deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
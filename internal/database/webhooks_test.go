@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestSubscribedUsers(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestDB(t)
+
+	first := &Webhook{TokenID: "token", URL: "https://example.com/a", SteamIDs: []int64{1, 2}}
+	second := &Webhook{TokenID: "token", URL: "https://example.com/b", SteamIDs: []int64{2, 3}}
+	for _, hook := range []*Webhook{first, second} {
+		if err := db.CreateWebhook(ctx, hook); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeleteWebhook(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := db.SubscribedUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(ids)
+	if want := []int64{1, 2}; !slices.Equal(ids, want) {
+		t.Errorf("SubscribedUsers() = %v, want %v", ids, want)
+	}
+}
+
+func TestRecordDelivery(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+
+	hook := &Webhook{TokenID: "token", URL: "https://example.com/hook", SteamIDs: []int64{1}}
+	if err := db.CreateWebhook(ctx, hook); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		success      bool
+		wantDisabled bool
+		wantFailures int
+	}{
+		{false, false, 1},
+		{true, false, 0}, // A success resets the failures in a row
+		{false, false, 1},
+		{false, true, 2},
+		{false, false, 3}, // Already disabled
+	} {
+		disabled, err := db.RecordDelivery(ctx, hook.ID, &WebhookDelivery{ID: "event", Success: tt.success}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disabled != tt.wantDisabled {
+			t.Errorf("delivery %d: disabled = %v, want %v", i+1, disabled, tt.wantDisabled)
+		}
+		got, err := db.GetWebhook(ctx, hook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Failures != tt.wantFailures {
+			t.Errorf("delivery %d: failures = %d, want %d", i+1, got.Failures, tt.wantFailures)
+		}
+	}
+
+	deliveries, err := db.GetDeliveries(ctx, hook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 5 {
+		t.Errorf("got %d deliveries, want 5", len(deliveries))
+	}
+
+	// A delivery finishing after the webhook is deleted leaves nothing behind.
+	if err := db.DeleteWebhook(ctx, hook); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RecordDelivery(ctx, hook.ID, &WebhookDelivery{ID: "late"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("keys left behind: %v", keys)
+	}
+}
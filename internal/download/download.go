@@ -0,0 +1,176 @@
+// Package download fetches images from the Steam CDN. Only allowlisted hosts
+// are contacted, never on a private address, and responses are bounded in size
+// and checked to be images.
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/imagemeta"
+	"github.com/mrmarble/steam-avatars/internal/metrics"
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const maxRedirects = 3
+
+var (
+	ErrHostNotAllowed = errors.New("host not allowed")
+	ErrBlockedAddress = errors.New("address not allowed")
+	ErrTooLarge       = errors.New("response too large")
+	ErrNotImage       = errors.New("not a supported image")
+)
+
+// File is a downloaded image.
+type File struct {
+	URL  string
+	Meta *imagemeta.Meta // Read from the content rather than the headers
+	Data []byte
+}
+
+type Downloader struct {
+	client  *http.Client
+	hosts   []string
+	maxSize int64
+}
+
+func New(config config.DownloadConfig) *Downloader {
+	d := &Downloader{hosts: config.Hosts, maxSize: int64(config.MaxSize)}
+
+	transport := &http.Transport{
+		Proxy:                 nil, // A proxy would resolve the hosts instead of the dialer
+		DialContext:           NewDialer().DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	d.client = &http.Client{
+		Timeout:   config.Timeout,
+		Transport: otelhttp.NewTransport(transport),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			return d.checkURL(req.URL)
+		},
+	}
+
+	return d
+}
+
+// NewDialer returns a dialer refusing private, loopback and other internal
+// addresses, for requests to URLs that come from outside.
+func NewDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: 5 * time.Second,
+		// Checked on the resolved address so DNS can't point an allowed host
+		// at an internal service.
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if isBlocked(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+}
+
+// Get downloads the image at rawURL.
+func (d *Downloader) Get(ctx context.Context, rawURL string) (file *File, err error) {
+	ctx, span := tracing.Start(ctx, "download", attribute.String("url.full", rawURL))
+	defer func() { tracing.End(span, err) }()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q: %w", rawURL, err)
+	}
+	if err := d.checkURL(u); err != nil {
+		return nil, fmt.Errorf("failed to download %q: %w", rawURL, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q: %w", rawURL, err)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %q: unexpected status code: %d", rawURL, resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); !strings.HasPrefix(mediaType, "image/") && mediaType != "application/octet-stream" {
+		return nil, fmt.Errorf("failed to download %q: %w: content type %q", rawURL, ErrNotImage, mediaType)
+	}
+	if resp.ContentLength > d.maxSize {
+		return nil, fmt.Errorf("failed to download %q: %w: %d bytes", rawURL, ErrTooLarge, resp.ContentLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, d.maxSize+1))
+	metrics.CDNBytes.Add(float64(len(data)))
+	span.SetAttributes(attribute.Int("download.bytes", len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q: %w", rawURL, err)
+	}
+	if int64(len(data)) > d.maxSize {
+		return nil, fmt.Errorf("failed to download %q: %w", rawURL, ErrTooLarge)
+	}
+
+	meta, err := imagemeta.Read(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q: %w: %w", rawURL, ErrNotImage, err)
+	}
+
+	return &File{URL: rawURL, Meta: meta, Data: data}, nil
+}
+
+// checkURL rejects the URLs that aren't HTTPS on an allowed host.
+func (d *Downloader) checkURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q", ErrHostNotAllowed, u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range d.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok && strings.HasSuffix(host, suffix) {
+			return nil
+		}
+		if host == allowed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+}
+
+func isBlocked(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() ||
+		sharedAddressSpace.Contains(addr)
+}
+
+// sharedAddressSpace is used by carrier-grade NAT and isn't reachable from the
+// internet.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
@@ -0,0 +1,182 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+)
+
+func TestIsBlocked(t *testing.T) {
+	for _, tt := range []struct {
+		addr    string
+		blocked bool
+	}{
+		{"8.8.8.8", false},
+		{"23.62.10.1", false},
+		{"2001:4860:4860::8888", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.0.1", true},
+		{"169.254.169.254", true}, // Cloud metadata
+		{"100.64.0.1", true},      // Carrier-grade NAT
+		{"0.0.0.0", true},
+		{"::", true},
+		{"224.0.0.1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+	} {
+		if got := isBlocked(netip.MustParseAddr(tt.addr)); got != tt.blocked {
+			t.Errorf("isBlocked(%s) = %v, want %v", tt.addr, got, tt.blocked)
+		}
+	}
+}
+
+func TestDialerRejectsInternalAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, err = NewDialer().DialContext(context.Background(), "tcp", listener.Addr().String())
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("dial error = %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestGetRejectsInternalHosts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The host is allowed, but resolves to a loopback address.
+	d := New(config.DownloadConfig{Hosts: []string{"localhost"}, MaxSize: 1 << 20, Timeout: 5 * time.Second})
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	if _, err := d.Get(context.Background(), "https://localhost:"+port+"/avatar.png"); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Get() error = %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	d := &Downloader{hosts: []string{"*.steamstatic.com", "steamcdn-a.akamaihd.net"}}
+	for _, tt := range []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://avatars.steamstatic.com/a.jpg", true},
+		{"https://cdn.AKAMAI.steamstatic.com/a.jpg", true},
+		{"https://steamcdn-a.akamaihd.net/a.jpg", true},
+		{"http://avatars.steamstatic.com/a.jpg", false},
+		{"https://evilsteamstatic.com/a.jpg", false},
+		{"https://steamstatic.com.evil.example/a.jpg", false},
+		{"https://akamaihd.net/a.jpg", false},
+		{"file:///etc/passwd", false},
+	} {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.checkURL(u); (err == nil) != tt.allowed {
+			t.Errorf("checkURL(%s) = %v, want allowed %v", tt.url, err, tt.allowed)
+		}
+	}
+}
+
+// roundTripper answers requests from a map of URLs to handlers, without any
+// network.
+type roundTripper map[string]func() *http.Response
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	respond, ok := rt[req.URL.String()]
+	if !ok {
+		return nil, errors.New("unexpected request to " + req.URL.String())
+	}
+	resp := respond()
+	resp.Request = req
+	return resp, nil
+}
+
+func redirect(location string) func() *http.Response {
+	return func() *http.Response {
+		return &http.Response{StatusCode: http.StatusFound, Header: http.Header{"Location": {location}}, Body: http.NoBody}
+	}
+}
+
+func file(contentType string, data []byte) func() *http.Response {
+	return func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {contentType}}, Body: io.NopCloser(bytes.NewReader(data)), ContentLength: -1}
+	}
+}
+
+func TestGet(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	const avatar = "https://avatars.steamstatic.com/a.png"
+
+	for _, tt := range []struct {
+		name      string
+		transport roundTripper
+		maxSize   int
+		err       error // Nil for a successful download
+	}{
+		{"image", roundTripper{avatar: file("image/png", img.Bytes())}, 1 << 20, nil},
+		{"redirect to an allowed host", roundTripper{avatar: redirect("https://cdn.steamstatic.com/a.png"), "https://cdn.steamstatic.com/a.png": file("image/png", img.Bytes())}, 1 << 20, nil},
+		{"redirect to another host", roundTripper{avatar: redirect("https://169.254.169.254/latest/meta-data/")}, 1 << 20, ErrHostNotAllowed},
+		{"redirect to http", roundTripper{avatar: redirect("http://avatars.steamstatic.com/a.png")}, 1 << 20, ErrHostNotAllowed},
+		{"too large", roundTripper{avatar: file("image/png", img.Bytes())}, 10, ErrTooLarge},
+		{"not an image", roundTripper{avatar: file("text/html", []byte("<html>"))}, 1 << 20, ErrNotImage},
+		{"not an image despite the type", roundTripper{avatar: file("image/png", []byte("<html>"))}, 1 << 20, ErrNotImage},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(config.DownloadConfig{Hosts: []string{"*.steamstatic.com"}, MaxSize: tt.maxSize, Timeout: 5 * time.Second})
+			d.client.Transport = tt.transport
+
+			file, err := d.Get(context.Background(), avatar)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Get() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.Meta.MIME != "image/png" || !bytes.Equal(file.Data, img.Bytes()) {
+				t.Errorf("Get() = %s with %d bytes, want the PNG", file.Meta.MIME, len(file.Data))
+			}
+		})
+	}
+}
+
+func TestGetTooManyRedirects(t *testing.T) {
+	const base = "https://avatars.steamstatic.com/"
+	transport := roundTripper{}
+	for i := range maxRedirects + 1 {
+		transport[base+string(rune('a'+i))] = redirect(base + string(rune('a'+i+1)))
+	}
+
+	d := New(config.DownloadConfig{Hosts: []string{"*.steamstatic.com"}, MaxSize: 1 << 20, Timeout: 5 * time.Second})
+	d.client.Transport = transport
+	if _, err := d.Get(context.Background(), base+"a"); err == nil {
+		t.Error("Get() followed too many redirects")
+	}
+}
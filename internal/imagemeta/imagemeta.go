@@ -0,0 +1,274 @@
+// Package imagemeta reads the format, dimensions and animation of an image
+// from its headers and chunks, without decoding its pixels.
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+var ErrUnsupported = errors.New("unsupported image format")
+
+// Meta describes an image.
+type Meta struct {
+	Format     string `json:"format"` // png, apng, gif, jpeg or webp
+	MIME       string `json:"mime"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Frames     int    `json:"frames"`
+	DurationMS int64  `json:"duration_ms"` // Of one loop of the animation
+	Animated   bool   `json:"animated"`
+}
+
+// Duration returns the length of one loop of the animation.
+func (m *Meta) Duration() time.Duration {
+	return time.Duration(m.DurationMS) * time.Millisecond
+}
+
+// Sniff returns the MIME type of an image from its magic bytes, or an empty
+// string if the format isn't supported. Animated PNGs are told apart from
+// still ones.
+func Sniff(data []byte) string {
+	switch {
+	case isPNG(data):
+		if frames, _ := pngAnimation(data); frames > 0 {
+			return "image/apng"
+		}
+		return "image/png"
+	case isGIF(data):
+		return "image/gif"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg"
+	case isWebP(data):
+		return "image/webp"
+	}
+
+	return ""
+}
+
+// Read returns the metadata of an image.
+func Read(data []byte) (*Meta, error) {
+	var (
+		meta *Meta
+		err  error
+	)
+	switch Sniff(data) {
+	case "image/png", "image/apng":
+		meta, err = readPNG(data)
+	case "image/gif":
+		meta, err = readGIF(data)
+	case "image/jpeg":
+		meta, err = readConfig(data, "jpeg", "image/jpeg")
+	case "image/webp":
+		meta, err = readWebP(data)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Animated = meta.Frames > 1
+	return meta, nil
+}
+
+func readConfig(data []byte, format, mime string) (*Meta, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Meta{Format: format, MIME: mime, Width: config.Width, Height: config.Height, Frames: 1}, nil
+}
+
+func isPNG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n"))
+}
+
+// pngChunks calls fn with the type and data of each chunk of a PNG until it
+// returns false.
+func pngChunks(data []byte, fn func(typ string, chunk []byte) bool) {
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 8 + length
+		if length < 0 || end > len(data) {
+			return
+		}
+		if !fn(string(data[i+4:i+8]), data[i+8:end]) {
+			return
+		}
+		i = end + 4 // CRC
+	}
+}
+
+// pngAnimation returns the number of frames and the length of an APNG, or no
+// frames if it's a still PNG. The animation control chunk must come before the
+// image data.
+func pngAnimation(data []byte) (int, time.Duration) {
+	var (
+		frames   int
+		duration time.Duration
+	)
+	pngChunks(data, func(typ string, chunk []byte) bool {
+		switch {
+		case typ == "acTL" && len(chunk) >= 4:
+			frames = int(binary.BigEndian.Uint32(chunk))
+		case typ == "IDAT" && frames == 0:
+			return false
+		case typ == "fcTL" && len(chunk) >= 24:
+			num := time.Duration(binary.BigEndian.Uint16(chunk[20:]))
+			den := time.Duration(binary.BigEndian.Uint16(chunk[22:]))
+			if den == 0 {
+				den = 100
+			}
+			duration += num * time.Second / den
+		}
+		return true
+	})
+
+	return frames, duration
+}
+
+func readPNG(data []byte) (*Meta, error) {
+	meta, err := readConfig(data, "png", "image/png")
+	if err != nil {
+		return nil, err
+	}
+
+	if frames, duration := pngAnimation(data); frames > 0 {
+		meta.Format, meta.MIME = "apng", "image/apng"
+		meta.Frames = frames
+		meta.DurationMS = duration.Milliseconds()
+	}
+
+	return meta, nil
+}
+
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+var errTruncated = errors.New("truncated image")
+
+// readGIF walks the blocks of a GIF, counting the frames and adding up their
+// delays.
+func readGIF(data []byte) (*Meta, error) {
+	if len(data) < 13 {
+		return nil, errTruncated
+	}
+	meta := &Meta{
+		Format: "gif",
+		MIME:   "image/gif",
+		Width:  int(binary.LittleEndian.Uint16(data[6:])),
+		Height: int(binary.LittleEndian.Uint16(data[8:])),
+	}
+
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1) // Global color table
+	}
+
+	var delay time.Duration
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // Extension
+			if i+2 > len(data) {
+				return nil, errTruncated
+			}
+			if data[i+1] == 0xf9 && i+6 <= len(data) { // Graphic control
+				delay = time.Duration(binary.LittleEndian.Uint16(data[i+4:])) * 10 * time.Millisecond
+			}
+			i = skipSubBlocks(data, i+2)
+		case 0x2c: // Image descriptor
+			if i+10 > len(data) {
+				return nil, errTruncated
+			}
+			meta.Frames++
+			meta.DurationMS += delay.Milliseconds()
+			delay = 0
+
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1) // Local color table
+			}
+			i = skipSubBlocks(data, i+1) // After the LZW minimum code size
+		case 0x3b: // Trailer
+			return meta, nil
+		default:
+			return nil, errors.New("invalid GIF block")
+		}
+		if i < 0 {
+			return nil, errTruncated
+		}
+	}
+
+	// Tolerate a missing trailer as browsers do.
+	if meta.Frames == 0 {
+		return nil, errTruncated
+	}
+	return meta, nil
+}
+
+// skipSubBlocks returns the offset after the data sub-blocks starting at i, or
+// -1 if they are truncated.
+func skipSubBlocks(data []byte, i int) int {
+	for i < len(data) {
+		size := int(data[i])
+		i++
+		if size == 0 {
+			return i
+		}
+		i += size
+	}
+
+	return -1
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+}
+
+// readWebP reads the canvas and frames of an extended WebP, which animated
+// ones are, and falls back to the decoder for simple ones.
+func readWebP(data []byte) (*Meta, error) {
+	meta := &Meta{Format: "webp", MIME: "image/webp"}
+
+	for i := 12; i+8 <= len(data); {
+		typ := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size
+		if size < 0 || end > len(data) {
+			return nil, errTruncated
+		}
+		chunk := data[i+8 : end]
+
+		switch {
+		case typ == "VP8X" && len(chunk) >= 10:
+			meta.Width = 1 + (int(chunk[4]) | int(chunk[5])<<8 | int(chunk[6])<<16)
+			meta.Height = 1 + (int(chunk[7]) | int(chunk[8])<<8 | int(chunk[9])<<16)
+		case typ == "ANMF" && len(chunk) >= 16:
+			meta.Frames++
+			meta.DurationMS += int64(chunk[12]) | int64(chunk[13])<<8 | int64(chunk[14])<<16
+		case typ == "VP8 " || typ == "VP8L":
+			if meta.Width == 0 {
+				return readConfig(data, "webp", "image/webp")
+			}
+			meta.Frames = max(meta.Frames, 1)
+		}
+		i = end + end%2 // Chunks are padded to an even size
+	}
+
+	if meta.Width == 0 {
+		return nil, errTruncated
+	}
+	meta.Frames = max(meta.Frames, 1)
+	return meta, nil
+}
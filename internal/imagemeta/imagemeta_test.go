@@ -0,0 +1,217 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func fcTL(num, den uint16) []byte {
+	data := make([]byte, 26)
+	binary.BigEndian.PutUint16(data[20:], num)
+	binary.BigEndian.PutUint16(data[22:], den)
+
+	return pngChunk("fcTL", data)
+}
+
+// encodeAPNG turns a PNG into an animation of two frames, 100ms and 500ms
+// long, the second with the default denominator.
+func encodeAPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	still := encodePNG(t, width, height)
+	ihdrEnd := 8 + 8 + 13 + 4
+
+	var apng []byte
+	apng = append(apng, still[:ihdrEnd]...)
+	apng = append(apng, pngChunk("acTL", []byte{0, 0, 0, 2, 0, 0, 0, 0})...)
+	apng = append(apng, fcTL(1, 10)...)
+	apng = append(apng, fcTL(50, 0)...)
+
+	return append(apng, still[ihdrEnd:]...)
+}
+
+var palette = color.Palette{color.Black, color.White}
+
+func encodeGIF(t *testing.T, width, height int, delays ...int) []byte {
+	t.Helper()
+
+	return encodeAnimation(t, &gif.GIF{}, width, height, delays...)
+}
+
+// encodeGlobalGIF is like encodeGIF but with a global color table instead of
+// one per frame.
+func encodeGlobalGIF(t *testing.T, width, height int, delays ...int) []byte {
+	t.Helper()
+
+	return encodeAnimation(t, &gif.GIF{Config: image.Config{ColorModel: palette, Width: width, Height: height}}, width, height, delays...)
+}
+
+func encodeAnimation(t *testing.T, anim *gif.GIF, width, height int, delays ...int) []byte {
+	t.Helper()
+
+	for _, delay := range delays {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, width, height), palette))
+		anim.Delay = append(anim.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	data := []byte("RIFF")
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(body)))
+
+	return append(data, body...)
+}
+
+func webpChunk(typ string, data []byte) []byte {
+	chunk := append([]byte(typ), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+
+	return chunk
+}
+
+// encodeWebP returns a lossless WebP, with only the header of its bitstream.
+func encodeWebP(width, height int) []byte {
+	bits := uint32(width-1) | uint32(height-1)<<14
+
+	return riff(webpChunk("VP8L", append([]byte{0x2f}, binary.LittleEndian.AppendUint32(nil, bits)...)))
+}
+
+func uint24(v int) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+// encodeAnimatedWebP returns an extended WebP with a frame per duration, with
+// only the headers of the frames.
+func encodeAnimatedWebP(width, height int, durations ...int) []byte {
+	vp8x := append([]byte{0x02, 0, 0, 0}, uint24(width-1)...)
+	vp8x = append(vp8x, uint24(height-1)...)
+	chunks := [][]byte{webpChunk("VP8X", vp8x), webpChunk("ANIM", make([]byte, 6))}
+	for _, duration := range durations {
+		frame := make([]byte, 16)
+		copy(frame[6:], uint24(width-1))
+		copy(frame[9:], uint24(height-1))
+		copy(frame[12:], uint24(duration))
+		chunks = append(chunks, webpChunk("ANMF", frame))
+	}
+
+	return riff(chunks...)
+}
+
+func TestRead(t *testing.T) {
+	gifData := encodeGIF(t, 4, 3, 10, 20)
+	gifWithoutTrailer := gifData[:len(gifData)-1]
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want Meta
+	}{
+		{"png", encodePNG(t, 3, 2), Meta{Format: "png", MIME: "image/png", Width: 3, Height: 2, Frames: 1}},
+		{"apng", encodeAPNG(t, 3, 2), Meta{Format: "apng", MIME: "image/apng", Width: 3, Height: 2, Frames: 2, DurationMS: 600, Animated: true}},
+		{"gif", encodeGIF(t, 4, 3, 0), Meta{Format: "gif", MIME: "image/gif", Width: 4, Height: 3, Frames: 1}},
+		{"animated gif", encodeGIF(t, 4, 3, 10, 20), Meta{Format: "gif", MIME: "image/gif", Width: 4, Height: 3, Frames: 2, DurationMS: 300, Animated: true}},
+		{"gif with a global color table", encodeGlobalGIF(t, 4, 3, 5, 5, 5), Meta{Format: "gif", MIME: "image/gif", Width: 4, Height: 3, Frames: 3, DurationMS: 150, Animated: true}},
+		{"gif without trailer", gifWithoutTrailer, Meta{Format: "gif", MIME: "image/gif", Width: 4, Height: 3, Frames: 2, DurationMS: 300, Animated: true}},
+		{"jpeg", encodeJPEG(t, 5, 4), Meta{Format: "jpeg", MIME: "image/jpeg", Width: 5, Height: 4, Frames: 1}},
+		{"webp", encodeWebP(6, 5), Meta{Format: "webp", MIME: "image/webp", Width: 6, Height: 5, Frames: 1}},
+		{"animated webp", encodeAnimatedWebP(184, 184, 40, 60, 100), Meta{Format: "webp", MIME: "image/webp", Width: 184, Height: 184, Frames: 3, DurationMS: 200, Animated: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := Read(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *meta != tt.want {
+				t.Errorf("Read() = %+v, want %+v", *meta, tt.want)
+			}
+			if mime := Sniff(tt.data); mime != tt.want.MIME {
+				t.Errorf("Sniff() = %q, want %q", mime, tt.want.MIME)
+			}
+		})
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	gifData := encodeGIF(t, 4, 3, 10, 20)
+	webpData := encodeAnimatedWebP(184, 184, 40)
+	invalidGIF := bytes.Clone(gifData)
+	invalidGIF[len(invalidGIF)-1] = 0x00
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  error // Nil for any error
+	}{
+		{"empty", nil, ErrUnsupported},
+		{"html", []byte("<!doctype html>"), ErrUnsupported},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), ErrUnsupported},
+		{"gif header only", gifData[:10], errTruncated},
+		{"gif without frames", gifData[:13], errTruncated},
+		{"gif with an invalid block", invalidGIF, nil},
+		{"gif cut in a frame", gifData[:len(gifData)/2+10], nil},
+		{"webp cut in a chunk", webpData[:len(webpData)-4], errTruncated},
+		{"webp without chunks", riff(), errTruncated},
+		{"png header only", encodePNG(t, 3, 2)[:8], nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := Read(tt.data)
+			if err == nil {
+				t.Fatalf("Read() = %+v, want an error", meta)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Read() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
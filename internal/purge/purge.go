@@ -0,0 +1,192 @@
+// Package purge removes the avatars of a user from the CDN caches in front of
+// the server when they change, instead of waiting for them to expire.
+package purge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Purger removes cached responses from a CDN.
+type Purger interface {
+	Purge(ctx context.Context, urls, tags []string) error
+}
+
+// Tags returns the cache tags of the avatar responses of a user, sent as
+// Cache-Tag and Surrogate-Key so they can be purged together.
+func Tags(steamID string) []string {
+	return []string{"avatar-" + steamID}
+}
+
+// New returns the purgers configured, or nil if there are none.
+func New(config config.PurgeConfig) Purger {
+	client := &http.Client{Timeout: config.Timeout, Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+	var purgers multi
+	if config.Webhook != "" {
+		purgers = append(purgers, &Webhook{client: client, url: config.Webhook, token: config.WebhookToken})
+	}
+	if config.CloudflareZone != "" {
+		purgers = append(purgers, &Cloudflare{
+			client: client,
+			api:    strings.TrimSuffix(config.CloudflareAPI, "/"),
+			zone:   config.CloudflareZone,
+			token:  config.CloudflareToken,
+			byTag:  config.CloudflareByTag,
+		})
+	}
+
+	switch len(purgers) {
+	case 0:
+		return nil
+	case 1:
+		return purgers[0]
+	}
+	return purgers
+}
+
+// Hook returns a database.UserChangeFunc purging the avatars of the users that
+// change. The purge runs in the background so it doesn't hold up the request
+// or refresh storing the change, and failures are only logged.
+func Hook(logger zerolog.Logger, purger Purger, baseURL string) database.UserChangeFunc {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	return func(ctx context.Context, before, after *database.User) {
+		steamID := strconv.FormatInt(after.ID, 10)
+		urls := []string{baseURL + "/avatar/" + steamID}
+		tags := Tags(steamID)
+
+		ctx = context.WithoutCancel(ctx)
+		go func() {
+			ctx, span := tracing.Start(ctx, "purge", attribute.String("steam.id", steamID))
+			err := purger.Purge(ctx, urls, tags)
+			tracing.End(span, err)
+			if err != nil {
+				logger.Error().Err(err).Str("steam_id", steamID).Msg("failed to purge avatar")
+				return
+			}
+			logger.Debug().Str("steam_id", steamID).Msg("purged avatar")
+		}()
+	}
+}
+
+// multi purges from every purger, so one failing doesn't stop the others.
+type multi []Purger
+
+func (m multi) Purge(ctx context.Context, urls, tags []string) error {
+	var errs []error
+	for _, p := range m {
+		errs = append(errs, p.Purge(ctx, urls, tags))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Webhook POSTs the URLs and tags to purge as JSON, for CDNs without built in
+// support or a custom purge service.
+type Webhook struct {
+	client *http.Client
+	url    string
+	token  string // Sent as a bearer token when set
+}
+
+type webhookPayload struct {
+	URLs []string `json:"urls"`
+	Tags []string `json:"tags"`
+}
+
+func (w *Webhook) Purge(ctx context.Context, urls, tags []string) error {
+	header := http.Header{}
+	if w.token != "" {
+		header.Set("Authorization", "Bearer "+w.token)
+	}
+
+	resp, err := post(ctx, w.client, w.url, header, webhookPayload{URLs: urls, Tags: tags})
+	if err != nil {
+		return fmt.Errorf("failed to call purge webhook: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to call purge webhook: unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Cloudflare purges a zone through the Cloudflare API, by URL or by the
+// Cache-Tag header.
+type Cloudflare struct {
+	client *http.Client
+	api    string
+	zone   string
+	token  string
+	byTag  bool
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (cf *Cloudflare) Purge(ctx context.Context, urls, tags []string) error {
+	payload := map[string][]string{"files": urls}
+	if cf.byTag {
+		payload = map[string][]string{"tags": tags}
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+cf.token)
+
+	resp, err := post(ctx, cf.client, cf.api+"/zones/"+cf.zone+"/purge_cache", header, payload)
+	if err != nil {
+		return fmt.Errorf("failed to purge Cloudflare cache: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result cloudflareResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return fmt.Errorf("failed to purge Cloudflare cache: unexpected status code: %d", resp.StatusCode)
+	}
+	if !result.Success {
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("failed to purge Cloudflare cache: %d: %s", result.Errors[0].Code, result.Errors[0].Message)
+		}
+		return fmt.Errorf("failed to purge Cloudflare cache: unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func post(ctx context.Context, client *http.Client, url string, header http.Header, payload any) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "steam-avatars")
+
+	return client.Do(req)
+}
@@ -0,0 +1,221 @@
+package purge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/rs/zerolog"
+)
+
+var (
+	testURLs = []string{"https://example.com/avatar/76561197960287930"}
+	testTags = Tags("76561197960287930")
+)
+
+// request is what a test server received.
+type request struct {
+	method, path, auth, contentType string
+	body                            map[string][]string
+}
+
+// newServer returns a server answering with status and body, and the requests
+// it received.
+func newServer(t *testing.T, status int, body string) (*httptest.Server, *[]request) {
+	t.Helper()
+
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{method: r.Method, path: r.URL.Path, auth: r.Header.Get("Authorization"), contentType: r.Header.Get("Content-Type")}
+		if err := json.NewDecoder(r.Body).Decode(&req.body); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		requests = append(requests, req)
+
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestWebhook(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		token    string
+		status   int
+		wantAuth string
+		wantErr  string
+	}{
+		{name: "accepted", status: http.StatusNoContent},
+		{name: "with token", token: "secret", status: http.StatusOK, wantAuth: "Bearer secret"},
+		{name: "rejected", status: http.StatusUnauthorized, wantErr: "unexpected status code: 401"},
+		{name: "server error", status: http.StatusBadGateway, wantErr: "unexpected status code: 502"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newServer(t, tt.status, "")
+			purger := New(config.PurgeConfig{Webhook: server.URL + "/purge", WebhookToken: tt.token, Timeout: time.Second})
+
+			err := purger.Purge(context.Background(), testURLs, testTags)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Purge() error = %v, want %q", err, tt.wantErr)
+			}
+
+			if len(*requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(*requests))
+			}
+			want := request{
+				method:      http.MethodPost,
+				path:        "/purge",
+				auth:        tt.wantAuth,
+				contentType: "application/json",
+				body:        map[string][]string{"urls": testURLs, "tags": testTags},
+			}
+			if got := (*requests)[0]; !reflect.DeepEqual(got, want) {
+				t.Errorf("request = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCloudflare(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		byTag    bool
+		status   int
+		response string
+		wantBody map[string][]string
+		wantErr  string
+	}{
+		{
+			name:     "by URL",
+			status:   http.StatusOK,
+			response: `{"success":true,"errors":[]}`,
+			wantBody: map[string][]string{"files": testURLs},
+		},
+		{
+			name:     "by tag",
+			byTag:    true,
+			status:   http.StatusOK,
+			response: `{"success":true,"errors":[]}`,
+			wantBody: map[string][]string{"tags": testTags},
+		},
+		{
+			name:     "API error",
+			status:   http.StatusBadRequest,
+			response: `{"success":false,"errors":[{"code":1012,"message":"Request must contain one of \"purge_everything\", \"files\", \"tags\""}]}`,
+			wantBody: map[string][]string{"files": testURLs},
+			wantErr:  `1012: Request must contain one of`,
+		},
+		{
+			name:     "failure without errors",
+			status:   http.StatusForbidden,
+			response: `{"success":false,"errors":[]}`,
+			wantBody: map[string][]string{"files": testURLs},
+			wantErr:  "unexpected status code: 403",
+		},
+		{
+			name:     "not JSON",
+			status:   http.StatusBadGateway,
+			response: "<html>Bad gateway</html>",
+			wantBody: map[string][]string{"files": testURLs},
+			wantErr:  "unexpected status code: 502",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newServer(t, tt.status, tt.response)
+			purger := New(config.PurgeConfig{
+				CloudflareZone:  "zone",
+				CloudflareToken: "token",
+				CloudflareAPI:   server.URL + "/client/v4/",
+				CloudflareByTag: tt.byTag,
+				Timeout:         time.Second,
+			})
+
+			err := purger.Purge(context.Background(), testURLs, testTags)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Purge() error = %v, want %q", err, tt.wantErr)
+			}
+
+			if len(*requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(*requests))
+			}
+			want := request{
+				method:      http.MethodPost,
+				path:        "/client/v4/zones/zone/purge_cache",
+				auth:        "Bearer token",
+				contentType: "application/json",
+				body:        tt.wantBody,
+			}
+			if got := (*requests)[0]; !reflect.DeepEqual(got, want) {
+				t.Errorf("request = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if purger := New(config.PurgeConfig{}); purger != nil {
+		t.Errorf("New() = %v without purgers, want nil", purger)
+	}
+
+	// One failing purger doesn't stop the others.
+	failing, failed := newServer(t, http.StatusInternalServerError, "")
+	cloudflare, purged := newServer(t, http.StatusOK, `{"success":true}`)
+	purger := New(config.PurgeConfig{
+		Webhook:        failing.URL,
+		CloudflareZone: "zone",
+		CloudflareAPI:  cloudflare.URL,
+		Timeout:        time.Second,
+	})
+	if err := purger.Purge(context.Background(), testURLs, testTags); err == nil {
+		t.Error("Purge() succeeded, want the webhook error")
+	}
+	if len(*failed) != 1 || len(*purged) != 1 {
+		t.Errorf("got %d webhook and %d Cloudflare requests, want 1 each", len(*failed), len(*purged))
+	}
+}
+
+type purgerFunc func(ctx context.Context, urls, tags []string) error
+
+func (f purgerFunc) Purge(ctx context.Context, urls, tags []string) error {
+	return f(ctx, urls, tags)
+}
+
+func TestHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	purged := make(chan []string, 1)
+	hook := Hook(zerolog.Nop(), purgerFunc(func(ctx context.Context, urls, tags []string) error {
+		if err := ctx.Err(); err != nil {
+			t.Errorf("purged with a cancelled context: %v", err)
+		}
+		purged <- append(urls, tags...)
+		return nil
+	}), "https://example.com/")
+
+	hook(ctx, &database.User{ID: 76561197960287930}, &database.User{ID: 76561197960287930})
+	cancel() // The request storing the change may end before the purge
+
+	select {
+	case got := <-purged:
+		if want := append(testURLs, testTags...); !reflect.DeepEqual(got, want) {
+			t.Errorf("purged %v, want %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the hook didn't purge")
+	}
+}
@@ -0,0 +1,202 @@
+// Package render draws stored avatars to SVG, PNG and GIF files.
+package render
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/server/templates"
+	xdraw "golang.org/x/image/draw"
+)
+
+type Options = templates.AvatarOptions
+
+var DefaultOptions = templates.DefaultAvatarOptions
+
+// The layout of the avatar, matching the viewBox of templates.Avatar.
+const (
+	canvasSize   = 224
+	avatarOffset = 20
+	avatarSize   = 184
+)
+
+// SVG writes the avatar as an SVG document with the images embedded.
+func SVG(w io.Writer, user *database.User, opts Options) error {
+	return templates.AvatarWithOptions(strconv.FormatInt(user.ID, 10), user.Avatar, user.Frame, opts).Render(context.Background(), w)
+}
+
+// PNG writes the first frame of the avatar as a PNG image.
+func PNG(w io.Writer, user *database.User, opts Options) error {
+	avatar, _, err := decodeImage(user.Avatar)
+	if err != nil {
+		return fmt.Errorf("failed to decode avatar: %w", err)
+	}
+	frame, err := decodeFrame(user, opts)
+	if err != nil {
+		return err
+	}
+
+	return png.Encode(w, compose(avatar[0], frame, opts))
+}
+
+// GIF writes the avatar as a GIF image, animated if the avatar is. The frame
+// is drawn as a still image.
+func GIF(w io.Writer, user *database.User, opts Options) error {
+	avatar, delays, err := decodeImage(user.Avatar)
+	if err != nil {
+		return fmt.Errorf("failed to decode avatar: %w", err)
+	}
+	frame, err := decodeFrame(user, opts)
+	if err != nil {
+		return err
+	}
+
+	// The first color is reserved for transparency.
+	pal := append(color.Palette{color.Transparent}, palette.Plan9[:255]...)
+
+	out := &gif.GIF{Config: image.Config{ColorModel: pal, Width: opts.Size, Height: opts.Size}}
+	for i, img := range avatar {
+		composed := compose(img, frame, opts)
+		paletted := image.NewPaletted(composed.Bounds(), pal)
+		draw.FloydSteinberg.Draw(paletted, composed.Bounds(), composed, image.Point{})
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, delays[i])
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+
+	return gif.EncodeAll(w, out)
+}
+
+func decodeFrame(user *database.User, opts Options) (image.Image, error) {
+	if !opts.Frame || user.Frame == "" {
+		return nil, nil
+	}
+
+	frame, _, err := decodeImage(user.Frame)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode frame: %w", err)
+	}
+
+	return frame[0], nil
+}
+
+// decodeImage returns every frame of the image in a data URI along with their
+// delays in hundredths of a second. Only GIFs are decoded as animations, APNGs
+// decode to their first frame.
+func decodeImage(uri string) ([]image.Image, []int, error) {
+	_, data, err := database.DecodeDataURI(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if format != "gif" {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		return []image.Image{img}, []int{0}, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return gifFrames(g), g.Delay, nil
+}
+
+// gifFrames returns the full canvas for every frame of a GIF, applying each
+// frame's disposal method.
+func gifFrames(g *gif.GIF) []image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]image.Image, 0, len(g.Image))
+
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, cloneRGBA(canvas))
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(img.Bounds())
+	copy(clone.Pix, img.Pix)
+	return clone
+}
+
+// compose draws the avatar and the frame on a canvas of opts.Size pixels.
+func compose(avatar, frame image.Image, opts Options) *image.RGBA {
+	scale := float64(opts.Size) / canvasSize
+	at := func(v float64) int { return int(math.Round(v * scale)) }
+
+	canvas := image.NewRGBA(image.Rect(0, 0, opts.Size, opts.Size))
+
+	avatarRect := image.Rect(at(avatarOffset), at(avatarOffset), at(avatarOffset+avatarSize), at(avatarOffset+avatarSize))
+	scaled := image.NewRGBA(avatarRect)
+	xdraw.CatmullRom.Scale(scaled, avatarRect, avatar, avatar.Bounds(), xdraw.Src, nil)
+
+	var mask image.Image
+	if opts.Circle {
+		mask = &circle{center: image.Pt(at(canvasSize/2), at(canvasSize/2)), radius: at(avatarSize / 2)}
+	}
+	draw.DrawMask(canvas, avatarRect, scaled, avatarRect.Min, mask, avatarRect.Min, draw.Over)
+
+	if frame != nil {
+		xdraw.CatmullRom.Scale(canvas, canvas.Bounds(), frame, frame.Bounds(), xdraw.Over, nil)
+	}
+
+	return canvas
+}
+
+// circle is an alpha mask that is opaque inside the circle.
+type circle struct {
+	center image.Point
+	radius int
+}
+
+func (c *circle) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (c *circle) Bounds() image.Rectangle {
+	return image.Rect(c.center.X-c.radius, c.center.Y-c.radius, c.center.X+c.radius, c.center.Y+c.radius)
+}
+
+func (c *circle) At(x, y int) color.Color {
+	dx, dy := float64(x-c.center.X)+0.5, float64(y-c.center.Y)+0.5
+	if dx*dx+dy*dy < float64(c.radius*c.radius) {
+		return color.Alpha{A: 255}
+	}
+	return color.Alpha{A: 0}
+}
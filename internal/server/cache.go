@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/server/templates"
+)
+
+// avatarRevision is part of the avatar ETags. Bump it when the SVG template
+// changes so cached avatars are fetched again.
+const avatarRevision = 1
+
+// cacheControl returns the Cache-Control header of the avatars.
+func cacheControl(config config.CacheConfig) string {
+	directives := []string{"public", fmt.Sprintf("max-age=%d", int(config.MaxAge.Seconds()))}
+	if config.SharedMaxAge > 0 {
+		directives = append(directives, fmt.Sprintf("s-maxage=%d", int(config.SharedMaxAge.Seconds())))
+	}
+	if config.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", int(config.StaleWhileRevalidate.Seconds())))
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// avatarETag identifies an avatar by the images it's drawn from and how, so it
+// only changes when the rendered SVG does. It's weak as the gzip middleware may
+// compress the SVG.
+func avatarETag(user *database.User, opts templates.AvatarOptions) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s:%s:%+v", avatarRevision, user.AvatarHash, user.FrameHash, opts)))
+
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setValidators sets the caching headers of a response and reports whether the
+// client already has it, in which case the caller should answer 304 instead.
+// If-None-Match takes precedence over If-Modified-Since, as in RFC 9110.
+func setValidators(c echo.Context, etag string, modified time.Time, cacheControl string) bool {
+	header := c.Response().Header()
+	header.Set("Cache-Control", cacheControl)
+	header.Set("ETag", etag)
+	if !modified.IsZero() {
+		header.Set(echo.HeaderLastModified, modified.UTC().Format(http.TimeFormat))
+	}
+
+	req := c.Request()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, etag)
+	}
+	if since, err := http.ParseTime(req.Header.Get(echo.HeaderIfModifiedSince)); err == nil && !modified.IsZero() {
+		return !modified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison required for it.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+)
+
+func TestCacheControl(t *testing.T) {
+	for _, tt := range []struct {
+		config config.CacheConfig
+		want   string
+	}{
+		{config.Default().Cache, "public, max-age=300, s-maxage=3600, stale-while-revalidate=86400"},
+		{config.CacheConfig{MaxAge: time.Minute}, "public, max-age=60"},
+	} {
+		if got := cacheControl(tt.config); got != tt.want {
+			t.Errorf("cacheControl(%+v) = %q, want %q", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   bool
+	}{
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"def", W/"abc"`, true},
+		{`*`, true},
+		{`"def"`, false},
+		{`"abcd"`, false},
+	} {
+		if got := etagMatches(tt.header, `W/"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestAvatarConditionalRequests(t *testing.T) {
+	s, db := newTestServer(t, nil)
+	user := &database.User{ID: 76561197960287930, DisplayName: "Rabscuttle", Avatar: "data:image/png;base64,", AvatarHash: "hash"}
+	if err := db.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/avatar/" + testSteamID
+	rec := serve(s, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	etag, modified := rec.Header().Get("ETag"), rec.Header().Get(echo.HeaderLastModified)
+	if etag == "" || modified == "" {
+		t.Fatalf("ETag %q, Last-Modified %q, want both", etag, modified)
+	}
+	if want := user.ChangedAt.UTC().Format(http.TimeFormat); modified != want {
+		t.Errorf("Last-Modified = %q, want when the avatar changed, %q", modified, want)
+	}
+
+	earlier := user.ChangedAt.Add(-time.Hour).UTC().Format(http.TimeFormat)
+	for _, tt := range []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"matching ETag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"matching ETag, gzipped", map[string]string{"If-None-Match": etag, echo.HeaderAcceptEncoding: "gzip"}, http.StatusNotModified},
+		{"other ETag", map[string]string{"If-None-Match": `W/"other"`}, http.StatusOK},
+		{"not modified since", map[string]string{echo.HeaderIfModifiedSince: modified}, http.StatusNotModified},
+		{"modified since", map[string]string{echo.HeaderIfModifiedSince: earlier}, http.StatusOK},
+		{"ETag over date", map[string]string{"If-None-Match": `W/"other"`, echo.HeaderIfModifiedSince: modified}, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+
+			rec := serve(s, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Header().Get("ETag") != etag || rec.Header().Get("Cache-Control") == "" {
+				t.Errorf("ETag %q, Cache-Control %q, want the validators on every response", rec.Header().Get("ETag"), rec.Header().Get("Cache-Control"))
+			}
+			if rec.Code == http.StatusNotModified && (rec.Body.Len() != 0 || rec.Header().Get(echo.HeaderContentEncoding) != "") {
+				t.Errorf("304 has a %d byte body, Content-Encoding %q", rec.Body.Len(), rec.Header().Get(echo.HeaderContentEncoding))
+			}
+		})
+	}
+}
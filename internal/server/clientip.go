@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/config"
+)
+
+// newIPExtractor returns the echo.IPExtractor behind c.RealIP, used by the rate
+// limiter, the logs and everything else keyed by client. X-Forwarded-For is
+// only read when the peer is a trusted proxy, so clients can't spoof it.
+func newIPExtractor(config config.ProxyConfig) (echo.IPExtractor, error) {
+	trusted, err := parsePrefixes(config.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	if config.CloudflareRanges != "" {
+		ranges, err := readPrefixes(config.CloudflareRanges)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Cloudflare ranges: %w", err)
+		}
+		trusted = append(trusted, ranges...)
+	}
+
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(req *http.Request) string {
+		// Peers on a Unix socket have no address and can only be a local proxy.
+		peer, ok := remoteAddr(req)
+		if ok && !isTrusted(peer) {
+			return peer.String()
+		}
+		fallback := ""
+		if ok {
+			fallback = peer.String()
+		}
+
+		var hops []netip.Addr
+		for _, header := range req.Header.Values(echo.HeaderXForwardedFor) {
+			for _, hop := range strings.Split(header, ",") {
+				addr, err := netip.ParseAddr(strings.TrimSpace(hop))
+				if err != nil {
+					// A malformed chain can't be trusted past the peer.
+					return fallback
+				}
+				hops = append(hops, addr.Unmap())
+			}
+		}
+
+		if config.ForwardedDepth > 0 {
+			if config.ForwardedDepth > len(hops) {
+				return fallback
+			}
+			return hops[len(hops)-config.ForwardedDepth].String()
+		}
+
+		// The client is the last address not added by one of our proxies.
+		for i := len(hops) - 1; i >= 0; i-- {
+			if !isTrusted(hops[i]) || i == 0 {
+				return hops[i].String()
+			}
+		}
+
+		return fallback
+	}, nil
+}
+
+// remoteAddr returns the address of the peer, or false if it isn't an IP
+// address.
+func remoteAddr(req *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+
+	return addr.Unmap(), err == nil
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			// Allow single addresses as well as ranges.
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// readPrefixes reads a file of CIDRs, one per line, such as the lists published
+// at https://www.cloudflare.com/ips/. Blank lines and # comments are ignored.
+func readPrefixes(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			values = append(values, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return parsePrefixes(values)
+}
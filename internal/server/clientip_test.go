@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+)
+
+func TestIPExtractor(t *testing.T) {
+	ranges := filepath.Join(t.TempDir(), "ips-v4")
+	if err := os.WriteFile(ranges, []byte("# Cloudflare\n173.245.48.0/20\n\n2400:cb00::/32 # IPv6\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	trusted := config.ProxyConfig{Trusted: []string{"10.0.0.0/8", "192.168.1.1"}}
+	for _, tt := range []struct {
+		name      string
+		config    config.ProxyConfig
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{"direct", trusted, "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed by an untrusted peer", trusted, "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", trusted, "10.0.0.2:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted single address", trusted, "192.168.1.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", trusted, "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"chain of proxies", trusted, "10.0.0.2:1234", []string{"198.51.100.9, 198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"chain over several headers", trusted, "10.0.0.2:1234", []string{"198.51.100.9", "198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"only proxies", trusted, "10.0.0.2:1234", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"malformed chain", trusted, "10.0.0.2:1234", []string{"198.51.100.1, nonsense"}, "10.0.0.2"},
+		{"IPv4 mapped", trusted, "[::ffff:10.0.0.2]:1234", []string{"::ffff:198.51.100.1"}, "198.51.100.1"},
+		{"IPv6 client", trusted, "10.0.0.2:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"unix socket", trusted, "@", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"unix socket without header", trusted, "@", nil, ""},
+		{"cloudflare", config.ProxyConfig{CloudflareRanges: ranges}, "173.245.48.5:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"cloudflare IPv6", config.ProxyConfig{CloudflareRanges: ranges}, "[2400:cb00::1]:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"depth", config.ProxyConfig{Trusted: []string{"10.0.0.0/8"}, ForwardedDepth: 2}, "10.0.0.2:1234", []string{"198.51.100.9, 198.51.100.1, 172.16.0.1"}, "198.51.100.1"},
+		{"depth past the chain", config.ProxyConfig{Trusted: []string{"10.0.0.0/8"}, ForwardedDepth: 3}, "10.0.0.2:1234", []string{"198.51.100.1, 172.16.0.1"}, "10.0.0.2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			extract, err := newIPExtractor(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.peer
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := extract(req); got != tt.want {
+				t.Errorf("client = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPExtractorInvalidProxy(t *testing.T) {
+	if _, err := newIPExtractor(config.ProxyConfig{Trusted: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("newIPExtractor() accepted an invalid CIDR")
+	}
+}
@@ -1,11 +1,19 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/download"
+	"github.com/mrmarble/steam-avatars/internal/imagemeta"
+	"github.com/mrmarble/steam-avatars/internal/purge"
 	"github.com/mrmarble/steam-avatars/internal/server/templates"
 	"github.com/mrmarble/steam-avatars/internal/steam"
 	"github.com/valkey-io/valkey-go"
@@ -18,73 +26,228 @@ func handleIndex(c echo.Context) error {
 
 func handleSearch(c echo.Context) error {
 	cc := c.(*Context)
-	name := c.FormValue("name")
+	name := steam.NormalizeQuery(c.FormValue("name"))
 	if name == "" {
 		return c.JSON(400, map[string]string{"error": "name is required"})
 	}
 
 	c.Logger().Info("searching for vanity URL ", name)
 
-	var err error
-	var user *database.User
-	if steam.IsSteamID(name) {
-		id, _ := strconv.ParseInt(name, 10, 64)
-		user, err = cc.db.GetUserByID(id)
-	} else {
-		user, err = cc.db.GetUserByVanityURL(name)
+	ctx := c.Request().Context()
+	user, err := LookupUser(ctx, cc.db, name)
+	if valkey.IsValkeyNil(err) {
+		if err := cc.allowUpstream(); err != nil {
+			return err
+		}
+		user, err = fetchUser(ctx, cc.db, cc.client, cc.downloader, name)
+		if errors.Is(err, steam.ErrNotFound) {
+			return c.JSON(404, map[string]string{"error": "user not found"})
+		}
+	} else if err != nil {
+		err = fmt.Errorf("failed to search for user: %w", err)
 	}
-	if err != nil && !valkey.IsValkeyNil(err) {
-		return fmt.Errorf("failed to search for user: %w", err)
+	if err != nil {
+		return err
+	}
+
+	if err := cc.db.TrackRequest(ctx, user.ID); err != nil {
+		c.Logger().Error("failed to track request: ", err)
+	}
+
+	return renderResult(cc, user, "")
+}
+
+// renderResult renders the result of a search, with an optional notice above
+// it.
+func renderResult(c *Context, user *database.User, notice string) error {
+	aliases, err := c.db.GetAliases(c.Request().Context(), user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get aliases: %w", err)
+	}
+
+	strID := strconv.FormatInt(user.ID, 10)
+	return renderView(c, templates.Result(strID, user.Avatar, user.Frame, c.Request().URL.Scheme+"://"+c.Request().Host+"/avatar/"+strID, user.AvatarMeta, user.FrameMeta, database.PreviousNames(aliases, user.DisplayName), notice))
+}
+
+// refreshResponse is the outcome of a manual refresh.
+type refreshResponse struct {
+	SteamID       string `json:"steam_id"`
+	Changed       bool   `json:"changed"` // Whether the avatar or frame differ from the stored ones
+	AvatarChanged bool   `json:"avatar_changed"`
+	FrameChanged  bool   `json:"frame_changed"`
+}
+
+// handleRefresh fetches a user from Steam again, bypassing the stored record,
+// so a new avatar or frame shows up without waiting for it to expire. Each
+// user can only be refreshed once per cooldown, which is only used up by
+// successful refreshes. htmx requests from the result page get the updated
+// result instead of JSON.
+func handleRefresh(c echo.Context) error {
+	cc := c.(*Context)
+	steamID := c.Param("steamID")
+	if !steam.IsSteamID(steamID) {
+		return c.JSON(400, map[string]string{"error": "invalid steamID"})
 	}
+	ID, _ := strconv.ParseInt(steamID, 10, 64)
+	ctx := c.Request().Context()
+	htmx := c.Request().Header.Get("HX-Request") == "true"
 
-	if user == nil {
-		user, err = searchUser(cc.client, name)
+	before, err := cc.db.GetUserByID(ctx, ID)
+	if err != nil && !valkey.IsValkeyNil(err) {
+		return c.JSON(500, map[string]string{"error": "failed to get user"})
+	}
+	// Without a record, the images are compared with the last ones seen.
+	var last *database.HistoryEntry
+	if before == nil {
+		history, err := cc.db.GetHistory(ctx, ID)
 		if err != nil {
-			return err
+			return c.JSON(500, map[string]string{"error": "failed to get user"})
 		}
-		err = cc.db.CreateUser(user)
-		if err != nil {
-			return err
+		if len(history) > 0 {
+			last = history[len(history)-1]
 		}
 	}
 
-	strID := strconv.FormatInt(user.ID, 10)
-	return renderView(c, templates.Result(strID, user.Avatar, user.Frame, c.Request().URL.Scheme+"://"+c.Request().Host+"/avatar/"+strID))
+	left, err := cc.db.ClaimRefresh(ctx, ID, cc.refreshCooldown)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to refresh user"})
+	}
+	if left > 0 {
+		if htmx && before != nil {
+			return renderResult(cc, before, fmt.Sprintf("Refreshed recently, try again in %s.", left.Round(time.Second)))
+		}
+		c.Response().Header().Set(echo.HeaderRetryAfter, seconds(left))
+		return c.JSON(429, map[string]string{"error": "user refreshed recently"})
+	}
+
+	// The claim keeps concurrent refreshes from all reaching Steam, but a
+	// refresh that fails gives it back.
+	release := func() {
+		if err := cc.db.ReleaseRefresh(context.WithoutCancel(ctx), ID); err != nil {
+			c.Logger().Error("failed to release refresh: ", err)
+		}
+	}
+	if err := cc.allowUpstream(); err != nil {
+		release()
+		return err
+	}
+	user, err := fetchUser(ctx, cc.db, cc.client, cc.downloader, steamID)
+	if err != nil {
+		release()
+	}
+	if errors.Is(err, steam.ErrNotFound) {
+		return c.JSON(404, map[string]string{"error": "user not found"})
+	} else if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to refresh user"})
+	}
+
+	res := refreshResponse{SteamID: steamID, AvatarChanged: true, FrameChanged: true}
+	switch {
+	case before != nil:
+		res.AvatarChanged = before.AvatarHash != user.AvatarHash
+		res.FrameChanged = before.FrameHash != user.FrameHash
+	case last != nil:
+		res.AvatarChanged = last.AvatarHash != user.AvatarHash
+		res.FrameChanged = last.FrameHash != user.FrameHash
+	}
+	res.Changed = res.AvatarChanged || res.FrameChanged
+
+	if htmx {
+		notice := "Already up to date."
+		if res.Changed {
+			notice = "Updated from Steam."
+		}
+		return renderResult(cc, user, notice)
+	}
+	return c.JSON(200, res)
+}
+
+// FindUser returns the stored user matching a normalised query, fetching and
+// storing it if there is none. It reports whether the user was stored.
+func FindUser(ctx context.Context, db *database.Database, c *steam.Client, d *download.Downloader, query string) (*database.User, bool, error) {
+	user, err := LookupUser(ctx, db, query)
+	if err == nil {
+		return user, true, nil
+	} else if !valkey.IsValkeyNil(err) {
+		return nil, false, fmt.Errorf("failed to search for user: %w", err)
+	}
+
+	user, err = fetchUser(ctx, db, c, d, query)
+	return user, false, err
 }
 
-func searchUser(c *steam.Client, query string) (*database.User, error) {
-	steamID, err := c.GetSteamID(query)
+// LookupUser returns the stored user matching a normalised query, or
+// valkey.Nil if there is none.
+func LookupUser(ctx context.Context, db *database.Database, query string) (*database.User, error) {
+	if steam.IsSteamID(query) {
+		id, _ := strconv.ParseInt(query, 10, 64)
+		return db.GetUserByID(ctx, id)
+	}
+
+	return db.GetUserByVanityURL(ctx, query)
+}
+
+// fetchUser fetches the user matching a normalised query from Steam and stores
+// it.
+func fetchUser(ctx context.Context, db *database.Database, c *steam.Client, d *download.Downloader, query string) (*database.User, error) {
+	user, err := SearchUser(ctx, c, d, query)
 	if err != nil {
 		return nil, err
 	}
+	if err := db.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
 
-	summary, err := c.GetPlayer(steamID)
+// SearchUser resolves the query to a Steam user and downloads its avatar and
+// frame. The result is not stored.
+func SearchUser(ctx context.Context, c *steam.Client, d *download.Downloader, query string) (*database.User, error) {
+	steamID, err := c.GetSteamID(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 
-	frame, err := downloadFrame(c, steamID)
+	summary, err := c.GetPlayer(ctx, steamID)
 	if err != nil {
 		return nil, err
 	}
-	avatar, err := donwloadAvatar(c, summary)
+
+	frameItem, frame, err := downloadFrame(ctx, c, d, steamID)
+	if err != nil {
+		return nil, err
+	}
+	avatarItem, avatar, err := donwloadAvatar(ctx, c, d, summary)
 	if err != nil {
 		return nil, err
 	}
 
 	ID, _ := strconv.ParseInt(steamID, 10, 64)
 
-	if avatar == "" {
-		avatar = summary.AvatarFull
-	}
-
-	return &database.User{
+	user := &database.User{
 		ID:          ID,
-		VanityURL:   query,
+		VanityURL:   summary.Vanity(),
 		DisplayName: summary.PersonaName,
-		Avatar:      avatar,
-		Frame:       frame,
-	}, nil
+		Avatar:      avatar.URI,
+		AvatarHash:  avatar.Hash,
+		AvatarURL:   avatar.URL,
+		AvatarMeta:  avatar.Meta,
+	}
+	if avatarItem != nil {
+		user.AvatarItemID = avatarItem.CommunityItemID
+		user.AvatarName = avatarItem.Name
+	}
+	if frame != nil {
+		user.Frame = frame.URI
+		user.FrameHash = frame.Hash
+		user.FrameURL = frame.URL
+		user.FrameMeta = frame.Meta
+		user.FrameItemID = frameItem.CommunityItemID
+		user.FrameName = frameItem.Name
+	}
+
+	return user, nil
 }
 
 func handleAvatar(c echo.Context) error {
@@ -95,23 +258,140 @@ func handleAvatar(c echo.Context) error {
 	}
 
 	ID, _ := strconv.ParseInt(steamID, 10, 64)
-	user, err := cc.db.GetUserByID(ID)
+	user, err := cc.db.GetUserByID(c.Request().Context(), ID)
 
 	if valkey.IsValkeyNil(err) {
-		user, err = searchUser(cc.client, steamID)
-		if err != nil {
+		if err := cc.allowUpstream(); err != nil {
+			return err
+		}
+		user, err = SearchUser(c.Request().Context(), cc.client, cc.downloader, steamID)
+		if errors.Is(err, steam.ErrNotFound) {
+			return c.JSON(404, map[string]string{"error": "user not found"})
+		} else if err != nil {
 			return c.JSON(500, map[string]string{"error": "failed to search for user"})
 		}
-		err = cc.db.CreateUser(user)
+		err = cc.db.CreateUser(c.Request().Context(), user)
 		if err != nil {
 			return c.JSON(500, map[string]string{"error": "failed to create user"})
 		}
-		return renderSVG(c, templates.Avatar(steamID, user.Avatar, user.Frame))
 	} else if err != nil {
 		return c.JSON(500, map[string]string{"error": "failed to get user"})
 	}
 
+	// Only users that exist are tracked, so made up IDs can't fill the
+	// refresher's candidates.
+	if err := cc.db.TrackRequest(c.Request().Context(), ID); err != nil {
+		c.Logger().Error("failed to track request: ", err)
+	}
+
+	tags := strings.Join(purge.Tags(steamID), ",")
+	c.Response().Header().Set("Cache-Tag", tags)
+	c.Response().Header().Set("Surrogate-Key", strings.ReplaceAll(tags, ",", " "))
+	if setValidators(c, avatarETag(user, templates.DefaultAvatarOptions), user.ChangedAt, cc.cacheControl) {
+		return c.NoContent(http.StatusNotModified)
+	}
 	avatar := templates.Avatar(steamID, user.Avatar, user.Frame)
 
 	return renderSVG(c, avatar)
 }
+
+func handleHistory(c echo.Context) error {
+	cc := c.(*Context)
+	steamID := c.Param("steamID")
+	if !steam.IsSteamID(steamID) {
+		return c.JSON(400, map[string]string{"error": "invalid steamID"})
+	}
+
+	ID, _ := strconv.ParseInt(steamID, 10, 64)
+	history, err := cc.db.GetHistory(c.Request().Context(), ID)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to get history"})
+	}
+
+	return renderView(c, templates.History(steamID, history))
+}
+
+func handleHistoryJSON(c echo.Context) error {
+	cc := c.(*Context)
+	steamID := c.Param("steamID")
+	if !steam.IsSteamID(steamID) {
+		return c.JSON(400, map[string]string{"error": "invalid steamID"})
+	}
+
+	ID, _ := strconv.ParseInt(steamID, 10, 64)
+	history, err := cc.db.GetHistory(c.Request().Context(), ID)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to get history"})
+	}
+	if history == nil {
+		history = []*database.HistoryEntry{}
+	}
+
+	return c.JSON(200, history)
+}
+
+func handleHistoryDownload(c echo.Context) error {
+	cc := c.(*Context)
+	steamID := c.Param("steamID")
+	hash := c.Param("hash")
+	if !steam.IsSteamID(steamID) {
+		return c.JSON(400, map[string]string{"error": "invalid steamID"})
+	}
+	if !isHash(hash) {
+		return c.JSON(400, map[string]string{"error": "invalid hash"})
+	}
+
+	blob, err := cc.db.GetBlob(c.Request().Context(), hash)
+	if valkey.IsValkeyNil(err) {
+		return c.JSON(404, map[string]string{"error": "image not found"})
+	} else if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to get image"})
+	}
+
+	mime, data, err := database.DecodeDataURI(blob)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to decode image"})
+	}
+	// Older blobs were labelled by where they came from rather than by content.
+	if sniffed := imagemeta.Sniff(data); sniffed != "" {
+		mime = sniffed
+	}
+
+	if c.QueryParam("download") != "" {
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", steamID+"_"+hash[:12]+database.FileExtension(mime)))
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	return c.Blob(200, mime, data)
+}
+
+func handleAliasesJSON(c echo.Context) error {
+	cc := c.(*Context)
+	steamID := c.Param("steamID")
+	if !steam.IsSteamID(steamID) {
+		return c.JSON(400, map[string]string{"error": "invalid steamID"})
+	}
+
+	ID, _ := strconv.ParseInt(steamID, 10, 64)
+	aliases, err := cc.db.GetAliases(c.Request().Context(), ID)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to get aliases"})
+	}
+	if aliases == nil {
+		aliases = []*database.AliasEntry{}
+	}
+
+	return c.JSON(200, aliases)
+}
+
+func handleVanityOwnersJSON(c echo.Context) error {
+	cc := c.(*Context)
+	vanity := steam.NormalizeQuery(c.Param("vanity"))
+
+	owners, err := cc.db.GetVanityOwners(c.Request().Context(), vanity)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to get vanity URL owners"})
+	}
+
+	return c.JSON(200, owners)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/config"
+)
+
+func TestRefreshCooldown(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		answer func(w http.ResponseWriter)
+		status int
+	}{
+		{
+			name: "Steam down",
+			answer: func(w http.ResponseWriter) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name: "not found",
+			answer: func(w http.ResponseWriter) {
+				w.Write([]byte(`{"response":{"players":[]}}`))
+			},
+			status: http.StatusNotFound,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			steamAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				tt.answer(w)
+			}))
+			t.Cleanup(steamAPI.Close)
+
+			s, db := newTestServer(t, func(c *config.Config) {
+				c.Steam.APIURL = steamAPI.URL
+				c.Limits.Upstream = config.RateLimit{Rate: 100, Burst: 100}
+			})
+			path := "/api/v1/users/" + testSteamID + "/refresh"
+
+			// A failed refresh gives the claim back, so it can be tried again
+			// right away.
+			for i := 1; i <= 2; i++ {
+				rec := serve(s, httptest.NewRequest(http.MethodPost, path, nil))
+				if rec.Code != tt.status {
+					t.Errorf("refresh %d: status = %d, want %d", i, rec.Code, tt.status)
+				}
+				if calls.Load() != int64(i) {
+					t.Errorf("refresh %d: Steam was called %d times, want %d", i, calls.Load(), i)
+				}
+			}
+
+			// A claimed refresh isn't sent to Steam until the cooldown ends.
+			if left, err := db.ClaimRefresh(context.Background(), 76561197960287930, time.Minute); err != nil || left != 0 {
+				t.Fatalf("ClaimRefresh() = %v, %v, want the claim", left, err)
+			}
+			rec := serve(s, httptest.NewRequest(http.MethodPost, path, nil))
+			if rec.Code != http.StatusTooManyRequests || rec.Header().Get(echo.HeaderRetryAfter) != "60" {
+				t.Errorf("status = %d, Retry-After %q during the cooldown, want 429 and 60", rec.Code, rec.Header().Get(echo.HeaderRetryAfter))
+			}
+			if calls.Load() != 2 {
+				t.Errorf("Steam was called during the cooldown")
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/steam"
+)
+
+// checkTimeout bounds each dependency check so a hung backend fails the probe
+// instead of timing it out.
+const checkTimeout = 2 * time.Second
+
+// health answers the liveness and readiness probes of the orchestrator.
+type health struct {
+	db       *database.Database
+	client   *steam.Client
+	config   config.HealthConfig
+	draining atomic.Bool // Set once Shutdown starts so traffic is moved away
+
+	mu        sync.Mutex
+	steamErr  error
+	steamTime time.Time // When the Steam Web API was last checked
+}
+
+// check is the status of a single dependency in the /readyz response.
+type check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Status string           `json:"status"`
+	Checks map[string]check `json:"checks"`
+}
+
+func newHealth(db *database.Database, client *steam.Client, config config.HealthConfig) *health {
+	return &health{db: db, client: client, config: config}
+}
+
+// handleHealthz reports that the process is alive.
+func (h *health) handleHealthz(c echo.Context) error {
+	return c.JSON(200, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the server can handle requests, along with the
+// status of each dependency.
+func (h *health) handleReadyz(c echo.Context) error {
+	ctx := c.Request().Context()
+	result := readiness{Status: "ok", Checks: map[string]check{}}
+
+	result.Checks["valkey"] = newCheck(h.pingValkey(ctx))
+	if h.config.SteamCheck {
+		result.Checks["steam"] = newCheck(h.pingSteam(ctx))
+	}
+	if h.draining.Load() {
+		result.Checks["server"] = check{Status: "draining"}
+	}
+
+	for _, check := range result.Checks {
+		if check.Status != "ok" {
+			result.Status = "unavailable"
+			return c.JSON(503, result)
+		}
+	}
+
+	return c.JSON(200, result)
+}
+
+func (h *health) pingValkey(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	return h.db.Ping(ctx)
+}
+
+// pingSteam checks the Steam Web API at most once per interval so the probes
+// don't use up the rate limit.
+func (h *health) pingSteam(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if time.Since(h.steamTime) < h.config.SteamInterval {
+		return h.steamErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	h.steamErr = h.client.Ping(ctx)
+	h.steamTime = time.Now()
+
+	return h.steamErr
+}
+
+func newCheck(err error) check {
+	if err != nil {
+		return check{Status: "error", Error: err.Error()}
+	}
+
+	return check{Status: "ok"}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/steam"
+)
+
+// readyz calls the readiness probe and returns its status code and response.
+func readyz(t *testing.T, h *health) (int, readiness) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/readyz", nil), rec)
+	if err := h.handleReadyz(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var result readiness
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code, result
+}
+
+func TestReadyz(t *testing.T) {
+	var steamUp atomic.Bool
+	steamUp.Store(true)
+	var steamCalls atomic.Int64
+	steamAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		steamCalls.Add(1)
+		if !steamUp.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"servertime":1700000000}`))
+	}))
+	t.Cleanup(steamAPI.Close)
+
+	db, valkeyServer := newTestDB(t)
+	client := steam.NewClient(config.SteamConfig{RateLimit: 100, APIURL: steamAPI.URL})
+	h := newHealth(db, client, config.HealthConfig{SteamCheck: true, SteamInterval: time.Hour})
+
+	if code, result := readyz(t, h); code != http.StatusOK || result.Status != "ok" {
+		t.Errorf("readyz = %d %+v, want 200 ok", code, result)
+	}
+
+	// The Steam check is reused within the interval.
+	steamUp.Store(false)
+	if code, result := readyz(t, h); code != http.StatusOK || steamCalls.Load() != 1 {
+		t.Errorf("readyz = %d %+v after %d Steam calls, want the cached 200", code, result, steamCalls.Load())
+	}
+
+	valkeyServer.Close()
+	code, result := readyz(t, h)
+	if code != http.StatusServiceUnavailable || result.Status != "unavailable" {
+		t.Errorf("readyz = %d %q with Valkey down, want 503 unavailable", code, result.Status)
+	}
+	if check := result.Checks["valkey"]; check.Status != "error" || check.Error == "" {
+		t.Errorf("valkey check = %+v, want the error", check)
+	}
+	if check := result.Checks["steam"]; check.Status != "ok" {
+		t.Errorf("steam check = %+v, want ok", check)
+	}
+}
+
+func TestReadyzDraining(t *testing.T) {
+	db, _ := newTestDB(t)
+	h := newHealth(db, nil, config.HealthConfig{})
+	h.draining.Store(true)
+
+	code, result := readyz(t, h)
+	if code != http.StatusServiceUnavailable || result.Checks["server"].Status != "draining" {
+		t.Errorf("readyz = %d %+v while draining, want 503 draining", code, result)
+	}
+	if _, ok := result.Checks["steam"]; ok {
+		t.Error("readyz checked Steam with the check disabled")
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	unixPrefix = "unix:"
+
+	// certCheckInterval is how often the certificate files are checked for
+	// changes, at most.
+	certCheckInterval = 10 * time.Second
+)
+
+// listen opens a TCP listener, or a Unix domain socket when the address starts
+// with "unix:". A socket left behind by a previous run is removed first.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Let the reverse proxy connect when it runs as another user of the group.
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// certReloader serves a TLS certificate from disk and loads it again when the
+// files change, so renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	log      zerolog.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Of the newest of both files when cert was loaded
+	checked time.Time
+}
+
+func newCertReloader(log zerolog.Logger, certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, log: log}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If a changed
+// certificate can't be loaded the previous one is kept.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= certCheckInterval {
+		if err := r.reload(); err != nil {
+			r.log.Error().Err(err).Msg("failed to reload TLS certificate, keeping the previous one")
+		}
+	}
+
+	return r.cert, nil
+}
+
+// reload loads the certificate if the files are newer than the one in use.
+// The caller must hold r.mu, except on creation.
+func (r *certReloader) reload() error {
+	r.checked = time.Now()
+
+	modTime, err := newestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	if r.cert != nil {
+		r.log.Info().Str("cert", r.certFile).Msg("reloaded TLS certificate")
+	}
+	r.cert = &cert
+	r.modTime = modTime
+
+	return nil
+}
+
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+func newestModTime(paths ...string) (time.Time, error) {
+	var newest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	return newest, nil
+}
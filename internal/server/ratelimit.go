@@ -0,0 +1,77 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/metrics"
+)
+
+// rateLimit limits the requests of each client, as identified by c.RealIP, or
+// by its API token. Probes are never limited.
+func rateLimit(store *database.RateLimiterStore) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if isProbe(c) {
+				return next(c)
+			}
+
+			cc := c.(*Context)
+			var err error
+			if cc.token != nil {
+				tokenStore := cc.db.RateLimiterStore("token", cc.token.Rate, cc.token.Burst)
+				err = checkRateLimit(c, tokenStore, cc.token.ID, "token")
+			} else {
+				err = checkRateLimit(c, store, c.RealIP(), "requests")
+			}
+			if err != nil {
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// allowUpstream counts a lookup from Steam against the upstream limit of the
+// client, returning an error if it's exceeded. Token requests are only limited
+// by the token.
+func (c *Context) allowUpstream() error {
+	if c.token != nil {
+		return nil
+	}
+
+	return checkRateLimit(c, c.upstream, c.RealIP(), "upstream")
+}
+
+// checkRateLimit counts the request against a limit and reports it in the
+// RateLimit-* headers. Requests are allowed when the limit can't be checked so
+// an unavailable store doesn't take the whole site down.
+func checkRateLimit(c echo.Context, store *database.RateLimiterStore, identifier, name string) error {
+	limit, err := store.Check(c.Request().Context(), identifier)
+	if err != nil {
+		c.Logger().Error("failed to check rate limit: ", err)
+		return nil
+	}
+
+	header := c.Response().Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(limit.Remaining))
+	header.Set("RateLimit-Reset", seconds(limit.Reset))
+
+	if !limit.Allowed {
+		metrics.RateLimited.WithLabelValues(name).Inc()
+		header.Set(echo.HeaderRetryAfter, seconds(limit.RetryAfter))
+		return echo.ErrTooManyRequests
+	}
+
+	return nil
+}
+
+// seconds formats d as whole seconds, rounded up so clients don't retry early.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
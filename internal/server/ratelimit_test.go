@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSeconds(t *testing.T) {
+	for _, tt := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0"},
+		{time.Microsecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	} {
+		if got := seconds(tt.d); got != tt.want {
+			t.Errorf("seconds(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	db, _ := newTestDB(t)
+	store := db.RateLimiterStore("requests", 0.5, 2)
+
+	e := echo.New()
+	for i, want := range []struct {
+		err        error
+		remaining  string
+		retryAfter string
+	}{
+		{nil, "1", ""},
+		{nil, "0", ""},
+		{echo.ErrTooManyRequests, "0", "2"},
+	} {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest("GET", "/", nil), rec)
+
+		if err := checkRateLimit(c, store, "client", "requests"); err != want.err {
+			t.Errorf("request %d: error = %v, want %v", i+1, err, want.err)
+		}
+		header := rec.Header()
+		if header.Get("RateLimit-Limit") != "2" || header.Get("RateLimit-Remaining") != want.remaining {
+			t.Errorf("request %d: RateLimit-Limit %q, RateLimit-Remaining %q, want 2 and %s", i+1, header.Get("RateLimit-Limit"), header.Get("RateLimit-Remaining"), want.remaining)
+		}
+		if got := header.Get(echo.HeaderRetryAfter); got != want.retryAfter {
+			t.Errorf("request %d: Retry-After = %q, want %q", i+1, got, want.retryAfter)
+		}
+	}
+}
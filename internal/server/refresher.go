@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/download"
+	"github.com/mrmarble/steam-avatars/internal/steam"
+	"github.com/rs/zerolog"
+)
+
+const refreshLock = "refresher"
+
+// refresher keeps the records of the most requested users fresh so they never
+// expire while being requested, and those with webhooks subscribed to them so
+// their changes are noticed without requests. Only the replica holding the
+// lock runs it.
+type refresher struct {
+	db     *database.Database
+	search func(ctx context.Context, query string) (*database.User, error) // Fetches a user from Steam
+	log    zerolog.Logger
+	config config.RefreshConfig
+	token  string
+
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+func newRefresher(log zerolog.Logger, db *database.Database, client *steam.Client, downloader *download.Downloader, config config.RefreshConfig) *refresher {
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+
+	return &refresher{
+		db: db,
+		search: func(ctx context.Context, query string) (*database.User, error) {
+			return SearchUser(ctx, client, downloader, query)
+		},
+		log:    log.With().Str("component", "refresher").Logger(),
+		config: config,
+		token:  hex.EncodeToString(token),
+	}
+}
+
+func (r *refresher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done.Add(1)
+
+	go func() {
+		defer r.done.Done()
+
+		ticker := time.NewTicker(r.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			r.run(ctx)
+
+			select {
+			case <-ctx.Done():
+				if err := r.db.ReleaseLock(context.Background(), refreshLock, r.token); err != nil {
+					r.log.Error().Err(err).Msg("failed to release lock")
+				}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (r *refresher) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.done.Wait()
+}
+
+func (r *refresher) run(ctx context.Context) {
+	// The lock outlives a cycle so the leader keeps it between runs.
+	leader, err := r.db.AcquireLock(ctx, refreshLock, r.token, 2*r.config.Interval)
+	if err != nil {
+		r.log.Error().Err(err).Msg("failed to acquire lock")
+		return
+	}
+	if !leader {
+		return
+	}
+
+	ids, subscribed, err := r.candidates(ctx)
+	if err != nil {
+		r.log.Error().Err(err).Msg("failed to get users to refresh")
+		return
+	}
+
+	refreshed := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		if r.refresh(ctx, id, subscribed[id]) {
+			refreshed++
+		}
+	}
+
+	if refreshed > 0 {
+		r.log.Info().Int("refreshed", refreshed).Int("candidates", len(ids)).Msg("refreshed users")
+	}
+}
+
+// candidates returns the IDs of the popular users followed by those of the
+// subscribed users that aren't popular, and which of them are subscribed.
+func (r *refresher) candidates(ctx context.Context) ([]int64, map[int64]bool, error) {
+	ids, err := r.db.PopularUsers(ctx, r.config.Top)
+	if err != nil {
+		return nil, nil, err
+	}
+	subscribedIDs, err := r.db.SubscribedUsers(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	popular := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		popular[id] = true
+	}
+	subscribed := make(map[int64]bool, len(subscribedIDs))
+	for _, id := range subscribedIDs {
+		// A scan may return a key more than once.
+		if !popular[id] && !subscribed[id] {
+			ids = append(ids, id)
+		}
+		subscribed[id] = true
+	}
+
+	return ids, subscribed, nil
+}
+
+// refresh fetches a user again if its record expires within the window, and
+// reports whether it did. Popular users that were never stored are skipped,
+// but subscribed ones are fetched so their changes are noticed even if nobody
+// looked them up. A panic is logged instead of stopping the refresher.
+func (r *refresher) refresh(ctx context.Context, id int64, subscribed bool) (refreshed bool) {
+	logger := r.log.With().Int64("steamID", id).Logger()
+	defer func() {
+		if v := recover(); v != nil {
+			logger.Error().Interface("panic", v).Msg("panic while refreshing user")
+			refreshed = false
+		}
+	}()
+
+	ttl, err := r.db.UserTTL(ctx, id)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get record TTL")
+		return false
+	}
+	if ttl > r.config.Before {
+		return false
+	}
+	if ttl < 0 && !subscribed {
+		known, err := r.db.HasHistory(ctx, id)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to get history")
+			return false
+		}
+		if !known {
+			return false
+		}
+	}
+
+	user, err := r.search(ctx, strconv.FormatInt(id, 10))
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to refresh user")
+		return false
+	}
+	if err := r.db.CreateUser(ctx, user); err != nil {
+		logger.Error().Err(err).Msg("failed to store user")
+		return false
+	}
+
+	return true
+}
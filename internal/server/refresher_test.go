@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/rs/zerolog"
+)
+
+func TestRefresherRun(t *testing.T) {
+	ctx := context.Background()
+	db, server := newTestDB(t)
+
+	const (
+		fresh      = 76561197960287931 // Popular, stored a moment ago
+		expired    = 76561197960287932 // Popular, its record expired but it has a history
+		unknown    = 76561197960287933 // Popular but never stored, like a made up ID
+		subscribed = 76561197960287934 // Subscribed to but never looked up
+		panics     = 76561197960287935 // Subscribed to, its fetch panics
+	)
+	for _, id := range []int64{fresh, expired} {
+		if err := db.CreateUser(ctx, &database.User{ID: id, AvatarHash: "hash"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Del("test:user:" + strconv.Itoa(expired))
+	for _, id := range []int64{fresh, expired, unknown} {
+		if err := db.TrackRequest(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CreateWebhook(ctx, &database.Webhook{TokenID: "token", URL: "https://example.com/hook", SteamIDs: []int64{subscribed, panics, fresh}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var searched []int64
+	r := &refresher{
+		db: db,
+		search: func(_ context.Context, query string) (*database.User, error) {
+			id, _ := strconv.ParseInt(query, 10, 64)
+			searched = append(searched, id)
+			if id == panics {
+				panic("bad response")
+			}
+			return &database.User{ID: id, AvatarHash: "hash"}, nil
+		},
+		log:    zerolog.Nop(),
+		config: config.RefreshConfig{Interval: time.Minute, Top: 10, Before: time.Hour},
+		token:  "test",
+	}
+	r.run(ctx)
+
+	slices.Sort(searched)
+	if want := []int64{expired, subscribed, panics}; !slices.Equal(searched, want) {
+		t.Errorf("refreshed %v, want %v", searched, want)
+	}
+	for _, id := range []int64{expired, subscribed} {
+		if _, err := db.GetUserByID(ctx, id); err != nil {
+			t.Errorf("user %d wasn't stored: %v", id, err)
+		}
+	}
+}
@@ -3,31 +3,65 @@ package server
 import (
 	"github.com/a-h/templ"
 	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/assets"
 )
 
 //go:generate templ generate "internal/server/templates/*"
 
 func setupRoutes(e *echo.Echo) {
-	e.Group("", func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			c.Response().Header().Set("Cache-Control", "public, max-age=604800")
-			return next(c)
-		}
-	}).Static("/static", "assets")
+	e.GET("/static/*", handleStatic)
 
 	e.GET("/", handleIndex)
 	e.POST("/", handleSearch)
 	e.GET("/avatar/:steamID", handleAvatar)
+	e.GET("/history/:steamID", handleHistory)
+	e.GET("/history/:steamID/:hash", handleHistoryDownload)
+	e.GET("/api/v1/users/:steamID/history", handleHistoryJSON)
+	e.GET("/api/v1/users/:steamID/aliases", handleAliasesJSON)
+	e.POST("/api/v1/users/:steamID/refresh", handleRefresh)
+	e.GET("/api/v1/vanity/:vanity/owners", handleVanityOwnersJSON)
+
+	webhooks := e.Group("/api/v1/webhooks", requireToken)
+	webhooks.POST("", handleCreateWebhook)
+	webhooks.GET("", handleListWebhooks)
+	webhooks.GET("/:id", handleGetWebhook)
+	webhooks.DELETE("/:id", handleDeleteWebhook)
+	webhooks.POST("/:id/enable", handleEnableWebhook)
+	webhooks.GET("/:id/deliveries", handleWebhookDeliveries)
+}
+
+// handleStatic serves the static files. Hashed names never change content so
+// they are cached forever, while the rest, like the fonts referenced from the
+// CSS, are cached for a week.
+func handleStatic(c echo.Context) error {
+	manifest := assets.Current()
+	name, immutable, ok := manifest.Lookup(c.Param("*"))
+	if !ok {
+		return echo.ErrNotFound
+	}
+
+	switch {
+	case manifest.Dev():
+		c.Response().Header().Set("Cache-Control", "no-cache")
+	case immutable:
+		c.Response().Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		c.Response().Header().Set("Cache-Control", "public, max-age=604800")
+	}
+
+	return echo.StaticFileHandler(name, manifest.FS)(c)
 }
 
+// renderView renders a page. It's written through the response rather than its
+// writer so the headers set before writing, like the security ones, are sent.
 func renderView(c echo.Context, cmp templ.Component) error {
 	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTML)
 
-	return cmp.Render(c.Request().Context(), c.Response().Writer)
+	return cmp.Render(c.Request().Context(), c.Response())
 }
 
 func renderSVG(c echo.Context, cmp templ.Component) error {
 	c.Response().Header().Set(echo.HeaderContentType, "image/svg+xml")
 
-	return cmp.Render(c.Request().Context(), c.Response().Writer)
+	return cmp.Render(c.Request().Context(), c.Response())
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/config"
+)
+
+// Content security policies by kind of response. The HTML one takes the nonce
+// of the request, which templ adds to the scripts of the pages.
+const (
+	defaultPolicy = "default-src 'none'; frame-ancestors 'none'"
+	htmlPolicy    = "default-src 'none'; script-src 'self' 'nonce-%[1]s'; style-src 'self'; img-src 'self' data:; font-src 'self'; connect-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors %[2]s"
+	imagePolicy   = "default-src 'none'; img-src data:; style-src 'unsafe-inline'; frame-ancestors %[1]s"
+)
+
+// securityHeaders sets the security headers of every response. The content
+// security policy is picked from the Content-Type once the handler sets it:
+// pages get a strict policy with a nonce, images one that lets them be
+// embedded, and everything else one that allows nothing.
+func securityHeaders(config config.SecurityConfig) echo.MiddlewareFunc {
+	htmlAncestors := strings.Join(config.FrameAncestors, " ")
+	imageAncestors := strings.Join(config.ImageFrameAncestors, " ")
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			nonce := newNonce()
+			req := c.Request()
+			c.SetRequest(req.WithContext(templ.WithNonce(req.Context(), nonce)))
+
+			header := c.Response().Header()
+			header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+			header.Set(echo.HeaderReferrerPolicy, "strict-origin-when-cross-origin")
+			if c.IsTLS() {
+				header.Set(echo.HeaderStrictTransportSecurity, "max-age=31536000")
+			}
+
+			// The timeout middleware swaps the writer, and with it the
+			// headers, so they're looked up again once written.
+			c.Response().Before(func() {
+				header := c.Response().Header()
+				contentType := header.Get(echo.HeaderContentType)
+				switch {
+				case strings.HasPrefix(contentType, echo.MIMETextHTML):
+					header.Set(echo.HeaderContentSecurityPolicy, fmt.Sprintf(htmlPolicy, nonce, htmlAncestors))
+					header.Set("Cross-Origin-Opener-Policy", "same-origin")
+				case strings.HasPrefix(contentType, "image/"):
+					header.Set(echo.HeaderContentSecurityPolicy, fmt.Sprintf(imagePolicy, imageAncestors))
+					header.Set("Cross-Origin-Resource-Policy", "cross-origin")
+				default:
+					header.Set(echo.HeaderContentSecurityPolicy, defaultPolicy)
+				}
+			})
+
+			return next(c)
+		}
+	}
+}
+
+func newNonce() string {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+
+	return base64.StdEncoding.EncodeToString(nonce)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+)
+
+const testSteamID = "76561197960287930"
+
+var noncePattern = regexp.MustCompile(`'nonce-([^']+)'`)
+
+func TestSecurityHeaders(t *testing.T) {
+	s, db := newTestServer(t, nil)
+	user := &database.User{ID: 76561197960287930, DisplayName: "Rabscuttle", Avatar: "data:image/png;base64,", AvatarHash: "hash"}
+	if err := db.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name, path  string
+		policy      string // Prefix of the policy
+		crossOrigin map[string]string
+	}{
+		{"index", "/", "default-src 'none'; script-src 'self' 'nonce-", map[string]string{"Cross-Origin-Opener-Policy": "same-origin"}},
+		{"history", "/history/" + testSteamID, "default-src 'none'; script-src 'self' 'nonce-", map[string]string{"Cross-Origin-Opener-Policy": "same-origin"}},
+		{"avatar", "/avatar/" + testSteamID, "default-src 'none'; img-src data:;", map[string]string{"Cross-Origin-Resource-Policy": "cross-origin"}},
+		{"JSON", "/api/v1/users/" + testSteamID + "/history", defaultPolicy, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(s, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+
+			policy := rec.Header().Get("Content-Security-Policy")
+			if !strings.HasPrefix(policy, tt.policy) {
+				t.Errorf("Content-Security-Policy = %q, want it to start with %q", policy, tt.policy)
+			}
+			if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+			for header, want := range tt.crossOrigin {
+				if got := rec.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+
+			if strings.Contains(tt.policy, "nonce") {
+				match := noncePattern.FindStringSubmatch(policy)
+				if match == nil {
+					t.Fatalf("no nonce in %q", policy)
+				}
+				if !strings.Contains(rec.Body.String(), `nonce="`+match[1]+`"`) {
+					t.Errorf("the scripts of the page don't have the nonce %q of the policy", match[1])
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersOnErrors(t *testing.T) {
+	s, _ := newTestServer(t, func(c *config.Config) {
+		c.Limits.Requests = config.RateLimit{Rate: 0.001, Burst: 1}
+	})
+
+	unauthorized := httptest.NewRequest(http.MethodGet, "/", nil)
+	unauthorized.Header.Set("Authorization", "Bearer invalid")
+	serve(s, httptest.NewRequest(http.MethodGet, "/", nil)) // Uses up the burst
+
+	for _, tt := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"invalid token", unauthorized, http.StatusUnauthorized},
+		{"rate limited", httptest.NewRequest(http.MethodGet, "/", nil), http.StatusTooManyRequests},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(s, tt.req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+			if got := rec.Header().Get("Content-Security-Policy"); got != defaultPolicy {
+				t.Errorf("Content-Security-Policy = %q, want %q", got, defaultPolicy)
+			}
+		})
+	}
+}
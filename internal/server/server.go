@@ -2,76 +2,223 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/mrmarble/steam-avatars/assets"
+	"github.com/mrmarble/steam-avatars/internal/config"
 	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/download"
+	"github.com/mrmarble/steam-avatars/internal/metrics"
+	"github.com/mrmarble/steam-avatars/internal/purge"
 	"github.com/mrmarble/steam-avatars/internal/steam"
+	"github.com/mrmarble/steam-avatars/internal/webhook"
 	"github.com/rs/zerolog"
 	"github.com/ziflex/lecho/v3"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 )
 
 type Server struct {
-	e *echo.Echo
+	e            *echo.Echo
+	address      string
+	tls          *certReloader // Serve HTTPS when set
+	admin        *echo.Echo    // Serves the internal endpoints on their own address when configured
+	adminAddress string
+	refresher    *refresher
+	notifier     *webhook.Notifier
+	health       *health
+	drainDelay   time.Duration
 }
 
 type Context struct {
-	db     *database.Database
-	client *steam.Client
+	db              *database.Database
+	client          *steam.Client
+	downloader      *download.Downloader
+	upstream        *database.RateLimiterStore // Limits the lookups from Steam of each client
+	token           *database.Token            // Set for requests made with an API token
+	cacheControl    string                     // Of the avatars
+	refreshCooldown time.Duration              // Between manual refreshes of a user
+	maxWebhooks     int                        // Per API token
 	echo.Context
 }
 
-func NewServer(logger zerolog.Logger, db *database.Database, steamApiKey string) *Server {
+func NewServer(logger zerolog.Logger, db *database.Database, config *config.Config) (*Server, error) {
 	l := lecho.From(logger)
 	e := echo.New()
-	client := steam.NewClient(steamApiKey)
+	client := steam.NewClient(config.Steam)
+	downloader := download.New(config.Download)
 
 	e.HideBanner = true
 	e.Logger = l
 
-	limiterStore := middleware.NewRateLimiterMemoryStore(20)
+	ipExtractor, err := newIPExtractor(config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	e.IPExtractor = ipExtractor
 
-	secureConfig := middleware.DefaultSecureConfig
-	secureConfig.XFrameOptions = ""
+	requests := db.RateLimiterStore("requests", config.Limits.Requests.Rate, config.Limits.Requests.Burst)
+	upstream := db.RateLimiterStore("upstream", config.Limits.Upstream.Rate, config.Limits.Upstream.Burst)
+	avatarCache := cacheControl(config.Cache)
 
 	e.Use(
+		metricsMiddleware,
 		middleware.RequestID(),
+		otelecho.Middleware("steam-avatars"),
+		traceRequestID,
 		lecho.Middleware(lecho.Config{
 			Logger:              l,
 			NestKey:             "request",
 			RequestLatencyLevel: zerolog.WarnLevel,
 			RequestLatencyLimit: 1 * time.Second,
 			Enricher: func(c echo.Context, logger zerolog.Context) zerolog.Context {
-				return logger.Str("connecting-ip", c.Request().Header.Get("CF-Connecting-IP")).
-					Str("country", c.Request().Header.Get("CF-IPCountry"))
+				return logger.Str("country", c.Request().Header.Get("CF-IPCountry"))
 			},
 		}),
+		// Before anything that may answer early, so errors get them too.
+		securityHeaders(config.Security),
 		func(next echo.HandlerFunc) echo.HandlerFunc {
 			return func(c echo.Context) error {
-				cc := &Context{db, client, c}
+				cc := &Context{
+					db:              db,
+					client:          client,
+					downloader:      downloader,
+					upstream:        upstream,
+					cacheControl:    avatarCache,
+					refreshCooldown: config.Refresh.Cooldown,
+					maxWebhooks:     config.Webhooks.MaxPerToken,
+					Context:         c,
+				}
 				return next(cc)
 			}
 		},
-		middleware.RateLimiter(limiterStore),
-		middleware.Gzip(),
+		authenticate,
+		rateLimit(requests),
+		// Empty bodies, such as those of the 304s replayed by the timeout
+		// middleware, are left alone instead of becoming empty gzip streams.
+		middleware.GzipWithConfig(middleware.GzipConfig{MinLength: 1}),
 		middleware.CORS(),
-		middleware.SecureWithConfig(secureConfig),
 		middleware.TimeoutWithConfig(middleware.TimeoutConfig{
 			Timeout: 3 * time.Second,
 		}),
 		middleware.Recover(),
 	)
 
+	if config.Server.AssetsDir != "" {
+		if err := assets.UseDir(config.Server.AssetsDir); err != nil {
+			return nil, fmt.Errorf("failed to serve static files from disk: %w", err)
+		}
+		logger.Warn().Str("dir", config.Server.AssetsDir).Msg("serving static files from disk")
+	}
 	setupRoutes(e)
 
-	return &Server{e}
+	s := &Server{
+		e:            e,
+		address:      config.Server.Address,
+		adminAddress: config.Server.AdminAddress,
+		health:       newHealth(db, client, config.Health),
+		drainDelay:   config.Server.DrainDelay,
+	}
+
+	// Internal endpoints are only public when there is no admin listener.
+	internal := e
+	if s.adminAddress != "" {
+		s.admin = echo.New()
+		s.admin.HideBanner = true
+		s.admin.Logger = l
+		internal = s.admin
+	}
+	internal.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	internal.GET("/healthz", s.health.handleHealthz)
+	internal.GET("/readyz", s.health.handleReadyz)
+
+	s.notifier = webhook.New(logger, db, config.Webhooks)
+	db.OnUserChange(s.notifier.Notify)
+	if purger := purge.New(config.Purge); purger != nil {
+		db.OnUserChange(purge.Hook(logger, purger, config.Purge.BaseURL))
+	}
+	if config.Refresh.Enabled {
+		s.refresher = newRefresher(logger, db, client, downloader, config.Refresh)
+	}
+	if config.Server.TLSCert != "" {
+		reloader, err := newCertReloader(logger, config.Server.TLSCert, config.Server.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		s.tls = reloader
+	}
+
+	return s, nil
 }
 
+// Start listens on the configured addresses and serves until Shutdown is
+// called. Addresses starting with "unix:" are Unix domain sockets.
 func (s *Server) Start() error {
-	return s.e.Start(":8080")
+	ln, err := listen(s.address)
+	if err != nil {
+		return err
+	}
+	if s.tls != nil {
+		s.e.Server.TLSConfig = s.tls.tlsConfig()
+		s.e.TLSListener = tls.NewListener(ln, s.e.Server.TLSConfig)
+	} else {
+		s.e.Listener = ln
+	}
+
+	if s.admin != nil {
+		adminLn, err := listen(s.adminAddress)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("admin listener: %w", err)
+		}
+		s.admin.Listener = adminLn
+		go func() {
+			if err := s.admin.Start(""); err != nil && err != http.ErrServerClosed {
+				s.e.Logger.Error("admin server: ", err)
+			}
+		}()
+	}
+	if s.refresher != nil {
+		s.refresher.Start()
+	}
+
+	return s.e.StartServer(s.e.Server)
 }
 
+// Shutdown fails the readiness probe for the drain delay so load balancers stop
+// sending traffic, then stops the server once the pending requests and webhook
+// deliveries are done.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.e.Shutdown(ctx)
+	s.health.draining.Store(true)
+	select {
+	case <-time.After(s.drainDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if s.refresher != nil {
+		s.refresher.Stop()
+	}
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if err := s.e.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	// The last requests and refreshes may have started deliveries.
+	return s.notifier.Shutdown(ctx)
+}
+
+// isProbe reports whether the request comes from the orchestrator probes,
+// which must never be rate limited.
+func isProbe(c echo.Context) bool {
+	path := c.Request().URL.Path
+	return path == "/healthz" || path == "/readyz"
 }
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/rs/zerolog"
+	"github.com/valkey-io/valkey-go"
+)
+
+// newTestDB returns a database backed by an in-memory server, along with the
+// server so tests can inspect it and move its clock.
+func newTestDB(t *testing.T) (*database.Database, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client, err := valkey.NewClient(valkey.ClientOption{
+		InitAddress:       []string{server.Addr()},
+		DisableCache:      true, // Client side caching isn't supported
+		ForceSingleClient: true, // It answers CLUSTER commands
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	return database.New(client, "test:"), server
+}
+
+// newTestServer returns a server with the default config, changed by
+// configure if not nil, on a database backed by an in-memory server.
+func newTestServer(t *testing.T, configure func(*config.Config)) (*Server, *database.Database) {
+	t.Helper()
+
+	db, _ := newTestDB(t)
+	cfg := config.Default()
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := NewServer(zerolog.Nop(), db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, db
+}
+
+// serve makes a request to the server and returns the recorded response.
+func serve(s *Server, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+
+	return rec
+}
@@ -8,7 +8,7 @@ package templates
 import "github.com/a-h/templ"
 import templruntime "github.com/a-h/templ/runtime"
 
-var scriptHanlde = templ.NewOnceHandle()
+import "github.com/mrmarble/steam-avatars/assets"
 
 func Index() templ.Component {
 	return templruntime.GeneratedTemplate(func(templ_7745c5c3_Input templruntime.GeneratedComponentInput) (templ_7745c5c3_Err error) {
@@ -28,10 +28,6 @@ func Index() templ.Component {
 			templ_7745c5c3_Var1 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<!doctype html><html><head><meta charset=\"utf-8\"><meta http-equiv=\"X-UA-Compatible\" content=\"IE=edge\"><title>Steam Avatars</title><meta name=\"description\" content=\"Extract your animated Steam avatar\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1\"><link rel=\"icon\" href=\"/static/favicon.ico\" type=\"image/x-icon\"><script src=\"https://unpkg.com/htmx.org@2.0.1\" defer></script><link rel=\"stylesheet\" href=\"/static/main.css\">")
-		if templ_7745c5c3_Err != nil {
-			return templ_7745c5c3_Err
-		}
 		templ_7745c5c3_Var2 := templruntime.GeneratedTemplate(func(templ_7745c5c3_Input templruntime.GeneratedComponentInput) (templ_7745c5c3_Err error) {
 			templ_7745c5c3_W, ctx := templ_7745c5c3_Input.Writer, templ_7745c5c3_Input.Context
 			templ_7745c5c3_Buffer, templ_7745c5c3_IsBuffer := templruntime.GetBuffer(templ_7745c5c3_W)
@@ -44,17 +40,26 @@ func Index() templ.Component {
 				}()
 			}
 			ctx = templ.InitializeContext(ctx)
-			_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<script>\n        function copyToClipboard(event) {\n          event.preventDefault();\n          event.stopPropagation();\n          console.log(event.currentTarget);\n          const input = event.currentTarget.querySelector('input');\n          input.focus();\n          input.select();\n          document.execCommand('copy');\n        }\n      </script>")
+			_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<main class=\"flex flex-col relative mt-[10%] mb-8 items-center\"><h1 class=\"text-5xl font-bold text-white mb-4\">STEAM AVATARS</h1><form class=\"\" hx-post=\"/\" hx-disabled-elt=\"find input[type=&#39;text&#39;], find button\" hx-target=\"#result\" hx-swap=\"innerHTML\"><input class=\"w-80\" type=\"text\" name=\"name\" placeholder=\"Steam ID or Vanity url\" required> <button type=\"submit\" class=\"green\" value=\"avatar\" name=\"target\"><img src=\"")
+			if templ_7745c5c3_Err != nil {
+				return templ_7745c5c3_Err
+			}
+			var templ_7745c5c3_Var3 string
+			templ_7745c5c3_Var3, templ_7745c5c3_Err = templ.JoinStringErrs(assets.Path("bars.svg"))
+			if templ_7745c5c3_Err != nil {
+				return templ.Error{Err: templ_7745c5c3_Err, FileName: `templates/index.html.templ`, Line: 12, Col: 39}
+			}
+			_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var3))
+			if templ_7745c5c3_Err != nil {
+				return templ_7745c5c3_Err
+			}
+			_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("\" class=\"htmx-indicator h-4 inline-block\" height=\"16\"> <span>Avatar</span></button></form></main><section id=\"result\" class=\"flex flex-col items-center\"></section>")
 			if templ_7745c5c3_Err != nil {
 				return templ_7745c5c3_Err
 			}
 			return templ_7745c5c3_Err
 		})
-		templ_7745c5c3_Err = scriptHanlde.Once().Render(templ.WithChildren(ctx, templ_7745c5c3_Var2), templ_7745c5c3_Buffer)
-		if templ_7745c5c3_Err != nil {
-			return templ_7745c5c3_Err
-		}
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</head><body><main class=\"flex flex-col relative mt-[10%] mb-8 items-center\"><h1 class=\"text-5xl font-bold text-white mb-4\">STEAM AVATARS</h1><form class=\"\" hx-post=\"/\" hx-disabled-elt=\"find input[type=&#39;text&#39;], find button\" hx-target=\"#result\" hx-swap=\"innerHTML\"><input class=\"w-80\" type=\"text\" name=\"name\" placeholder=\"Steam ID or Vanity url\" required> <button type=\"submit\" class=\"green\" value=\"avatar\" name=\"target\"><img src=\"/static/bars.svg\" class=\"htmx-indicator h-4 inline-block\" height=\"16\"> <span>Avatar</span></button></form></main><section id=\"result\" class=\"flex flex-col items-center\"></section></body></html>")
+		templ_7745c5c3_Err = Layout("Steam Avatars").Render(templ.WithChildren(ctx, templ_7745c5c3_Var2), templ_7745c5c3_Buffer)
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
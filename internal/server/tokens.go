@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/metrics"
+)
+
+// authenticate identifies the requests made with an API token in the
+// Authorization header. They are limited by the token instead of by address.
+// Requests without a token are anonymous.
+func authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cc := c.(*Context)
+		secret, ok := bearerToken(c.Request())
+		if !ok {
+			return next(c)
+		}
+
+		token, err := cc.db.GetToken(c.Request().Context(), secret)
+		if errors.Is(err, database.ErrInvalidToken) {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+		} else if err != nil {
+			return err
+		}
+
+		if !routeAllowed(token.Routes, c.Path()) {
+			return echo.NewHTTPError(http.StatusForbidden, "route not allowed for this token")
+		}
+
+		used, err := cc.db.CountTokenUsage(c.Request().Context(), token.ID)
+		if err != nil {
+			c.Logger().Error("failed to count token usage: ", err)
+		} else if token.DailyQuota > 0 && used > token.DailyQuota {
+			metrics.RateLimited.WithLabelValues("quota").Inc()
+			now := time.Now().UTC()
+			tomorrow := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			c.Response().Header().Set(echo.HeaderRetryAfter, seconds(tomorrow.Sub(now)))
+			return echo.NewHTTPError(http.StatusTooManyRequests, "daily quota exceeded")
+		}
+
+		cc.token = token
+		return next(c)
+	}
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get(echo.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// routeAllowed reports whether route matches one of the patterns, which are
+// either routes such as "/avatar/:steamID" or prefixes ending with "*". No
+// patterns allow every route.
+func routeAllowed(patterns []string, route string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(route, prefix) {
+			return true
+		}
+		if pattern == route {
+			return true
+		}
+	}
+
+	return false
+}
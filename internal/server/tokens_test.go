@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+)
+
+// tokenRequest returns a request to path made with the token secret.
+func tokenRequest(path, secret string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+secret)
+
+	return req
+}
+
+func TestTokenLimits(t *testing.T) {
+	historyPath := "/api/v1/users/" + testSteamID + "/history"
+
+	for _, tt := range []struct {
+		name  string
+		token database.Token
+		path  string
+		want  []int // Status of each request
+	}{
+		{
+			name:  "daily quota",
+			token: database.Token{Rate: 100, Burst: 100, DailyQuota: 2},
+			path:  historyPath,
+			want:  []int{200, 200, 429, 429},
+		},
+		{
+			name:  "rate",
+			token: database.Token{Rate: 0.001, Burst: 2},
+			path:  historyPath,
+			want:  []int{200, 200, 429},
+		},
+		{
+			// Well over the anonymous limit of the server.
+			name:  "unlimited quota",
+			token: database.Token{Rate: 100, Burst: 100},
+			path:  historyPath,
+			want:  []int{200, 200, 200, 200, 200},
+		},
+		{
+			name:  "allowed route",
+			token: database.Token{Rate: 100, Burst: 100, Routes: []string{"/api/*"}},
+			path:  historyPath,
+			want:  []int{200},
+		},
+		{
+			name:  "forbidden route",
+			token: database.Token{Rate: 100, Burst: 100, Routes: []string{"/avatar/:steamID"}},
+			path:  historyPath,
+			want:  []int{403},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestServer(t, func(c *config.Config) {
+				c.Limits.Requests = config.RateLimit{Rate: 0.001, Burst: 1}
+			})
+			secret, err := db.CreateToken(context.Background(), &tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range tt.want {
+				rec := serve(s, tokenRequest(tt.path, secret))
+				if rec.Code != want {
+					t.Errorf("request %d: status = %d, want %d", i+1, rec.Code, want)
+				}
+				if rec.Code == http.StatusTooManyRequests && rec.Header().Get(echo.HeaderRetryAfter) == "" {
+					t.Errorf("request %d: no Retry-After", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenUsage(t *testing.T) {
+	s, db := newTestServer(t, nil)
+	token := &database.Token{Rate: 100, Burst: 100}
+	secret, err := db.CreateToken(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		serve(s, tokenRequest("/", secret))
+	}
+	// Anonymous requests aren't counted against any token.
+	serve(s, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	usage, err := db.GetTokenUsage(context.Background(), token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Today != 3 || usage.Total != 3 || usage.LastUsed.IsZero() {
+		t.Errorf("usage = %+v, want 3 requests today and in total", usage)
+	}
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRequestID adds the request ID to the span of the request so traces can
+// be matched with the logs.
+func traceRequestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Response().Header().Get(echo.HeaderXRequestID)
+		trace.SpanFromContext(c.Request().Context()).SetAttributes(attribute.String("http.request_id", id))
+
+		return next(c)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider recording the spans of the test. It
+// must be called before the server is created, as otelecho gets its tracer
+// then.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return exporter
+}
+
+func TestTraceAvatarLookup(t *testing.T) {
+	exporter := recordSpans(t)
+
+	steamAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(steamAPI.Close)
+
+	s, _ := newTestServer(t, func(cfg *config.Config) {
+		cfg.Steam.APIURL = steamAPI.URL
+	})
+
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/avatar/"+testSteamID, nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	request, ok := spans["/avatar/:steamID"]
+	if !ok {
+		t.Fatalf("no span for the request, got %v", spanNames(exporter))
+	}
+	if request.Status.Code != codes.Error {
+		t.Errorf("request span status = %v, want an error", request.Status)
+	}
+
+	for _, name := range []string{"database.GetUserByID", "steam /ISteamUser/GetPlayerSummaries/v2/"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %q span, got %v", name, spanNames(exporter))
+			continue
+		}
+		if span.Parent.SpanID() != request.SpanContext.SpanID() {
+			t.Errorf("%q span isn't a child of the request span", name)
+		}
+	}
+
+	lookup := spans["steam /ISteamUser/GetPlayerSummaries/v2/"]
+	if lookup.Status.Code != codes.Error {
+		t.Errorf("Steam span status = %v, want an error", lookup.Status)
+	}
+	recorded := false
+	for _, event := range lookup.Events {
+		recorded = recorded || event.Name == "exception"
+	}
+	if !recorded {
+		t.Error("Steam span has no recorded error")
+	}
+}
+
+func spanNames(exporter *tracetest.InMemoryExporter) []string {
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		names = append(names, span.Name)
+	}
+
+	return names
+}
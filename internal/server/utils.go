@@ -1,57 +1,92 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"io"
-	"net/http"
 
+	"github.com/mrmarble/steam-avatars/internal/download"
+	"github.com/mrmarble/steam-avatars/internal/imagemeta"
 	"github.com/mrmarble/steam-avatars/internal/steam"
 )
 
-func downloadFile(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+func hashFile(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// asset is an image downloaded from the Steam CDN.
+type asset struct {
+	URL  string // Where the image was downloaded from
+	URI  string // Content as a data URI
+	Hash string // SHA-256 of the content
+	Meta *imagemeta.Meta
+}
+
+func downloadAsset(ctx context.Context, d *download.Downloader, url string) (*asset, error) {
+	file, err := d.Get(ctx, url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download file: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	return io.ReadAll(resp.Body)
+	return &asset{
+		URL:  url,
+		URI:  fmt.Sprintf("data:%s;base64,%s", file.Meta.MIME, base64.StdEncoding.EncodeToString(file.Data)),
+		Hash: hashFile(file.Data),
+		Meta: file.Meta,
+	}, nil
 }
 
-func downloadFrame(c *steam.Client, steamID string) (string, error) {
-	frame, err := c.GetAvatarFrame(steamID)
+// downloadFrame returns the avatar frame equipped by the user and its image.
+// It returns nil if no frame is equipped.
+func downloadFrame(ctx context.Context, c *steam.Client, d *download.Downloader, steamID string) (*steam.CommunityItem, *asset, error) {
+	frame, err := c.GetAvatarFrame(ctx, steamID)
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+	if frame == nil {
+		return nil, nil, nil
 	}
 
-	frameFile, err := downloadFile(frame)
+	file, err := downloadAsset(ctx, d, frame.URL())
 	if err != nil {
-		return "", fmt.Errorf("failed to download frame: %w", err)
+		return nil, nil, fmt.Errorf("failed to download frame: %w", err)
 	}
 
-	return fmt.Sprintf("data:image/apng;base64,%s", base64.StdEncoding.EncodeToString(frameFile)), nil
+	return frame, file, nil
 }
 
-func donwloadAvatar(c *steam.Client, player *steam.Player) (string, error) {
-	avatar, err := c.GetAnimatedAvatar(player.SteamID)
+// donwloadAvatar returns the animated avatar equipped by the user and its
+// image, falling back to the profile picture if there is none, in which case
+// the returned item is nil.
+func donwloadAvatar(ctx context.Context, c *steam.Client, d *download.Downloader, player *steam.Player) (*steam.CommunityItem, *asset, error) {
+	avatar, err := c.GetAnimatedAvatar(ctx, player.SteamID)
 	if err != nil {
-		return "", fmt.Errorf("failed to get animated avatar for %q: %w", player.SteamID, err)
+		return nil, nil, fmt.Errorf("failed to get animated avatar for %q: %w", player.SteamID, err)
 	}
 
-	if avatar == "" {
-		avatarFile, err := downloadFile(player.AvatarFull)
-		if err != nil {
-			return "", fmt.Errorf("failed to download avatar: %w", err)
-		}
-		avatar = fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(avatarFile))
-	} else {
-		avatarFile, err := downloadFile(avatar)
+	if avatar == nil {
+		file, err := downloadAsset(ctx, d, player.AvatarFull)
 		if err != nil {
-			return "", fmt.Errorf("failed to download animated avatar: %w", err)
+			return nil, nil, fmt.Errorf("failed to download avatar: %w", err)
 		}
-		avatar = fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(avatarFile))
+		return nil, file, nil
+	}
+
+	file, err := downloadAsset(ctx, d, avatar.URL())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download animated avatar: %w", err)
 	}
 
-	return avatar, nil
+	return avatar, file, nil
 }
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/steam"
+	"github.com/mrmarble/steam-avatars/internal/webhook"
+	"github.com/valkey-io/valkey-go"
+)
+
+// maxSubscriptions is how many users a webhook can be subscribed to.
+const maxSubscriptions = 100
+
+// webhookRequest creates a webhook.
+type webhookRequest struct {
+	URL      string   `json:"url"`
+	SteamIDs []string `json:"steam_ids"`
+}
+
+// webhookResponse describes a webhook. The secret is only included when it's
+// created.
+type webhookResponse struct {
+	ID         string     `json:"id"`
+	URL        string     `json:"url"`
+	SteamIDs   []string   `json:"steam_ids"`
+	Secret     string     `json:"secret,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Failures   int        `json:"failures"` // Events failed in a row
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+}
+
+func newWebhookResponse(hook *database.Webhook) webhookResponse {
+	res := webhookResponse{
+		ID:        hook.ID,
+		URL:       hook.URL,
+		SteamIDs:  make([]string, len(hook.SteamIDs)),
+		CreatedAt: hook.CreatedAt,
+		Failures:  hook.Failures,
+	}
+	for i, id := range hook.SteamIDs {
+		res.SteamIDs[i] = strconv.FormatInt(id, 10)
+	}
+	if !hook.DisabledAt.IsZero() {
+		res.DisabledAt = &hook.DisabledAt
+	}
+
+	return res
+}
+
+// requireToken returns an error unless the request was made with an API token,
+// which webhooks belong to.
+func requireToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.(*Context).token == nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return c.JSON(401, map[string]string{"error": "an API token is required"})
+		}
+
+		return next(c)
+	}
+}
+
+func handleCreateWebhook(c echo.Context) error {
+	cc := c.(*Context)
+
+	var req webhookRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "invalid request"})
+	}
+	if err := webhook.ValidateURL(req.URL); err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	if len(req.SteamIDs) == 0 || len(req.SteamIDs) > maxSubscriptions {
+		return c.JSON(400, map[string]string{"error": "between 1 and " + strconv.Itoa(maxSubscriptions) + " steam_ids are required"})
+	}
+
+	hook := &database.Webhook{TokenID: cc.token.ID, URL: req.URL}
+	seen := map[int64]bool{}
+	for _, steamID := range req.SteamIDs {
+		if !steam.IsSteamID(steamID) {
+			return c.JSON(400, map[string]string{"error": "invalid steamID " + strconv.Quote(steamID)})
+		}
+		ID, _ := strconv.ParseInt(steamID, 10, 64)
+		if !seen[ID] {
+			seen[ID] = true
+			hook.SteamIDs = append(hook.SteamIDs, ID)
+		}
+	}
+
+	ctx := c.Request().Context()
+	hooks, err := cc.db.ListWebhooks(ctx, cc.token.ID)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to list webhooks"})
+	}
+	if len(hooks) >= cc.maxWebhooks {
+		return c.JSON(409, map[string]string{"error": "too many webhooks for this token"})
+	}
+
+	if err := cc.db.CreateWebhook(ctx, hook); err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to create webhook"})
+	}
+
+	res := newWebhookResponse(hook)
+	res.Secret = hook.Secret
+	return c.JSON(201, res)
+}
+
+func handleListWebhooks(c echo.Context) error {
+	cc := c.(*Context)
+
+	hooks, err := cc.db.ListWebhooks(c.Request().Context(), cc.token.ID)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to list webhooks"})
+	}
+
+	res := make([]webhookResponse, len(hooks))
+	for i, hook := range hooks {
+		res[i] = newWebhookResponse(hook)
+	}
+
+	return c.JSON(200, res)
+}
+
+// ownWebhook returns the webhook of the request if it belongs to its token.
+// Other tokens' webhooks are reported as missing.
+func ownWebhook(c *Context) (*database.Webhook, error) {
+	hook, err := c.db.GetWebhook(c.Request().Context(), c.Param("id"))
+	if valkey.IsValkeyNil(err) || err == nil && hook.TokenID != c.token.ID {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return hook, nil
+}
+
+func handleGetWebhook(c echo.Context) error {
+	hook, err := ownWebhook(c.(*Context))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, newWebhookResponse(hook))
+}
+
+func handleDeleteWebhook(c echo.Context) error {
+	cc := c.(*Context)
+	hook, err := ownWebhook(cc)
+	if err != nil {
+		return err
+	}
+
+	if err := cc.db.DeleteWebhook(c.Request().Context(), hook); err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to delete webhook"})
+	}
+
+	return c.NoContent(204)
+}
+
+// handleEnableWebhook enables a webhook disabled after too many failures.
+func handleEnableWebhook(c echo.Context) error {
+	cc := c.(*Context)
+	hook, err := ownWebhook(cc)
+	if err != nil {
+		return err
+	}
+
+	if err := cc.db.EnableWebhook(c.Request().Context(), hook.ID); err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to enable webhook"})
+	}
+	hook.Failures, hook.DisabledAt = 0, time.Time{}
+
+	return c.JSON(200, newWebhookResponse(hook))
+}
+
+// handleWebhookDeliveries returns the latest deliveries of a webhook, newest
+// first.
+func handleWebhookDeliveries(c echo.Context) error {
+	cc := c.(*Context)
+	hook, err := ownWebhook(cc)
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := cc.db.GetDeliveries(c.Request().Context(), hook.ID)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to get deliveries"})
+	}
+	if deliveries == nil {
+		deliveries = []*database.WebhookDelivery{}
+	}
+
+	return c.JSON(200, deliveries)
+}
@@ -1,50 +1,100 @@
 package steam
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
-)
 
-const (
-	baseURL  = "https://api.steampowered.com"
-	assetURL = "https://cdn.akamai.steamstatic.com/steamcommunity/public/images/"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/metrics"
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
+const assetURL = "https://cdn.akamai.steamstatic.com/steamcommunity/public/images/"
+
+// ErrNotFound is returned when no Steam user matches a vanity URL or SteamID.
+var ErrNotFound = errors.New("steam user not found")
+
 type Client struct {
-	apiKey string
-	c      *http.Client
+	apiKey  string
+	baseURL string
+	c       *http.Client
+	limiter *rate.Limiter // Shared by every caller so the API key stays within its quota
 }
 
-func NewClient(apiKey string) *Client {
+// NewClient returns a client that makes at most config.RateLimit calls per
+// second to the Steam Web API.
+func NewClient(config config.SteamConfig) *Client {
 	return &Client{
-		apiKey: apiKey,
+		apiKey:  config.APIKey,
+		baseURL: strings.TrimSuffix(config.APIURL, "/"),
 		c: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		limiter: rate.NewLimiter(rate.Limit(config.RateLimit), max(1, int(config.RateLimit))),
 	}
 }
 
-func (c *Client) get(url string, params map[string]string, v interface{}) error {
-	// params
-	url += fmt.Sprintf("?key=%s", c.apiKey)
-	if len(params) > 0 {
-		for key, value := range params {
-			url += fmt.Sprintf("&%s=%s", key, value)
-		}
+func (c *Client) get(ctx context.Context, endpoint string, params map[string]string, v interface{}) (err error) {
+	ctx, span := tracing.Start(ctx, "steam "+endpoint, attribute.String("steam.endpoint", endpoint))
+	defer func() { tracing.End(span, err) }()
+
+	query := url.Values{}
+	for key, value := range params {
+		query.Set(key, value)
 	}
-	req, err := http.NewRequest("GET", baseURL+url, nil)
+	// The API key is only added to the request, never to what is recorded.
+	redacted := c.baseURL + endpoint + "?" + query.Encode()
+	span.SetAttributes(
+		attribute.String("http.request.method", http.MethodGet),
+		attribute.String("url.full", redacted),
+	)
+	query.Set("key", c.apiKey)
+
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+endpoint+"?"+query.Encode(), nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	err = c.do(req, v)
+	metrics.SteamDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.SteamRequests.WithLabelValues(endpoint, result).Inc()
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redacted
+	}
+
+	return err
+}
+
+func (c *Client) do(req *http.Request, v interface{}) error {
 	resp, err := c.c.Do(req)
 	if err != nil {
 		return err
 	}
 
 	defer resp.Body.Close()
+	trace.SpanFromContext(req.Context()).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
@@ -52,62 +102,113 @@ func (c *Client) get(url string, params map[string]string, v interface{}) error
 	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-func (c *Client) GetSteamID(vanityURL string) (string, error) {
+func (c *Client) GetSteamID(ctx context.Context, vanityURL string) (string, error) {
 	if IsSteamID(vanityURL) {
 		return vanityURL, nil
 	}
 
 	var data ResolveVanityURLResponse
-	err := c.get("/ISteamUser/ResolveVanityURL/v1/", map[string]string{"vanityurl": vanityURL}, &data)
+	err := c.get(ctx, "/ISteamUser/ResolveVanityURL/v1/", map[string]string{"vanityurl": vanityURL}, &data)
 	if err != nil {
 		return "", err
 	}
 	if data.Response.Success != 1 {
-		return "", fmt.Errorf("vanity url not found")
+		return "", ErrNotFound
 	}
 
 	return data.Response.SteamID, nil
 }
 
-func (c *Client) GetAvatarFrame(steamID string) (string, error) {
+// Ping checks that the Steam Web API is reachable. It counts towards the rate
+// limit like any other request.
+func (c *Client) Ping(ctx context.Context) error {
+	var data GetServerInfoResponse
+	return c.get(ctx, "/ISteamWebAPIUtil/GetServerInfo/v1/", nil, &data)
+}
+
+// GetAvatarFrame returns the avatar frame equipped by the user, or nil if the
+// user has none.
+func (c *Client) GetAvatarFrame(ctx context.Context, steamID string) (*CommunityItem, error) {
 	var data GetAvatarFrameResponse
-	err := c.get("/IPlayerService/GetAvatarFrame/v1/", map[string]string{"steamid": steamID}, &data)
+	err := c.get(ctx, "/IPlayerService/GetAvatarFrame/v1/", map[string]string{"steamid": steamID}, &data)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if data.Response.AvatarFrame.ImageSmall == "" {
-		return "", nil
+		return nil, nil
 	}
 
-	return fmt.Sprintf("%s%s", assetURL, data.Response.AvatarFrame.ImageSmall), nil
-
+	return &data.Response.AvatarFrame, nil
 }
 
-func (c *Client) GetAnimatedAvatar(steamID string) (string, error) {
+// GetAnimatedAvatar returns the animated avatar equipped by the user, or nil
+// if the user has none.
+func (c *Client) GetAnimatedAvatar(ctx context.Context, steamID string) (*CommunityItem, error) {
 	var data GetAnimatedAvatarResponse
-	err := c.get("/IPlayerService/GetAnimatedAvatar/v1/", map[string]string{"steamid": steamID}, &data)
+	err := c.get(ctx, "/IPlayerService/GetAnimatedAvatar/v1/", map[string]string{"steamid": steamID}, &data)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if data.Response.AvatarFrame.ImageSmall == "" {
-		return "", nil
+	if data.Response.Avatar.ImageSmall == "" {
+		return nil, nil
 	}
 
-	return fmt.Sprintf("%s%s", assetURL, data.Response.AvatarFrame.ImageSmall), nil
+	return &data.Response.Avatar, nil
 }
 
-func (c *Client) GetPlayer(steamID string) (*Player, error) {
+// GetPlayer returns the summary of a user, or ErrNotFound if there is no user
+// with the SteamID.
+func (c *Client) GetPlayer(ctx context.Context, steamID string) (*Player, error) {
 	var data GetPlayerSummariesResponse
-	err := c.get("/ISteamUser/GetPlayerSummaries/v2/", map[string]string{"steamids": steamID}, &data)
+	err := c.get(ctx, "/ISteamUser/GetPlayerSummaries/v2/", map[string]string{"steamids": steamID}, &data)
 	if err != nil {
 		return nil, err
 	}
+	if len(data.Response.Players) == 0 {
+		return nil, ErrNotFound
+	}
 
 	return &data.Response.Players[0], nil
 }
 
+// URL returns the absolute URL of the animated item image.
+func (i *CommunityItem) URL() string {
+	return fmt.Sprintf("%s%s", assetURL, i.ImageSmall)
+}
+
+// Vanity returns the custom URL of the player's profile, or an empty string if
+// the profile has none.
+func (p *Player) Vanity() string {
+	_, vanity, ok := strings.Cut(p.ProfileURL, "/id/")
+	if !ok {
+		return ""
+	}
+
+	return NormalizeQuery(vanity)
+}
+
+// NormalizeQuery turns a SteamID, vanity name or profile URL into either a
+// SteamID or a lowercase vanity name, so equivalent queries share a cache entry.
+func NormalizeQuery(query string) string {
+	query = strings.TrimSpace(query)
+	if i := strings.IndexAny(query, "?#"); i >= 0 {
+		query = query[:i]
+	}
+
+	for _, prefix := range []string{"/id/", "/profiles/"} {
+		if _, rest, ok := strings.Cut(query, prefix); ok {
+			query = rest
+			break
+		}
+	}
+
+	query, _, _ = strings.Cut(strings.Trim(query, "/"), "/")
+
+	return strings.ToLower(query)
+}
+
 func IsSteamID(name string) bool {
 	if len(name) != 17 {
 		return false
@@ -0,0 +1,156 @@
+package steam
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestClient returns a client calling handler instead of the Steam Web API.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return NewClient(config.SteamConfig{APIKey: "secret-key", RateLimit: 100, APIURL: server.URL})
+}
+
+func TestGetPlayerNotFound(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":{"players":[]}}`))
+	})
+
+	if _, err := c.GetPlayer(context.Background(), "76561197960287930"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetPlayer() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestGetSteamIDNotFound(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":{"success":42,"message":"No match"}}`))
+	})
+
+	if _, err := c.GetSteamID(context.Background(), "nobody"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetSteamID() error = %v, want ErrNotFound", err)
+	}
+}
+
+// recordSpans installs a tracer provider recording the spans of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return exporter
+}
+
+func TestSpans(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		handler http.HandlerFunc
+		closed  bool // Whether the server is down
+		status  int  // Recorded status code, 0 for none
+	}{
+		{
+			name: "ok",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"response":{"players":[{"steamid":"76561197960287930"}]}}`))
+			},
+			status: 200,
+		},
+		{
+			name: "status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			},
+			status: 403,
+		},
+		{
+			name:    "unreachable",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			closed:  true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := recordSpans(t)
+			var key string
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				key = r.URL.Query().Get("key")
+				tt.handler(w, r)
+			})
+			if tt.closed {
+				c.c.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					return nil, errors.New("connection refused")
+				})
+			}
+
+			_, err := c.GetPlayer(context.Background(), "76561197960287930")
+			if (err == nil) != (tt.status == 200) {
+				t.Fatalf("GetPlayer() error = %v", err)
+			}
+			if !tt.closed && key != "secret-key" {
+				t.Errorf("request had key %q, want the API key", key)
+			}
+			if err != nil && strings.Contains(err.Error(), "secret-key") {
+				t.Errorf("error %q contains the API key", err)
+			}
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("recorded %d spans, want 1", len(spans))
+			}
+			span := spans[0]
+			if want := "steam /ISteamUser/GetPlayerSummaries/v2/"; span.Name != want {
+				t.Errorf("span name = %q, want %q", span.Name, want)
+			}
+
+			attrs := map[attribute.Key]attribute.Value{}
+			for _, attr := range span.Attributes {
+				attrs[attr.Key] = attr.Value
+			}
+			if got := attrs["steam.endpoint"].AsString(); got != "/ISteamUser/GetPlayerSummaries/v2/" {
+				t.Errorf("steam.endpoint = %q", got)
+			}
+			if got := attrs["url.full"].AsString(); !strings.HasSuffix(got, "/ISteamUser/GetPlayerSummaries/v2/?steamids=76561197960287930") {
+				t.Errorf("url.full = %q, want the URL without the key", got)
+			}
+			if got := attrs["http.response.status_code"].AsInt64(); got != int64(tt.status) {
+				t.Errorf("http.response.status_code = %d, want %d", got, tt.status)
+			}
+
+			for _, attr := range span.Attributes {
+				if strings.Contains(attr.Value.Emit(), "secret-key") {
+					t.Errorf("attribute %s contains the API key", attr.Key)
+				}
+			}
+			for _, event := range span.Events {
+				for _, attr := range event.Attributes {
+					if strings.Contains(attr.Value.Emit(), "secret-key") {
+						t.Errorf("attribute %s of event %s contains the API key", attr.Key, event.Name)
+					}
+				}
+			}
+			if strings.Contains(span.Status.Description, "secret-key") {
+				t.Error("span status contains the API key")
+			}
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -1,26 +1,24 @@
 package steam
 
+// CommunityItem is an equippable item from the Steam points shop, such as an
+// avatar frame or an animated avatar.
+type CommunityItem struct {
+	AppID           int    `json:"appid"`
+	CommunityItemID string `json:"communityitemid"`
+	ImageLarge      string `json:"image_large"`
+	ImageSmall      string `json:"image_small"` // This is the URL to the animated image
+	Name            string `json:"name"`
+}
+
 type GetAvatarFrameResponse struct {
 	Response struct {
-		AvatarFrame struct {
-			AppID           int    `json:"appid"`
-			CommunityItemID string `json:"communityitemid"`
-			ImageLarge      string `json:"image_large"`
-			ImageSmall      string `json:"image_small"` // This is the URL to the animated frame
-			Name            string `json:"name"`
-		} `json:"avatar_frame"`
+		AvatarFrame CommunityItem `json:"avatar_frame"`
 	} `json:"response"`
 }
 
 type GetAnimatedAvatarResponse struct {
 	Response struct {
-		AvatarFrame struct {
-			AppID           int    `json:"appid"`
-			CommunityItemID string `json:"communityitemid"`
-			ImageLarge      string `json:"image_large"`
-			ImageSmall      string `json:"image_small"`
-			Name            string `json:"name"`
-		} `json:"avatar"`
+		Avatar CommunityItem `json:"avatar"`
 	} `json:"response"`
 }
 
@@ -37,6 +35,10 @@ type GetPlayerSummariesResponse struct {
 	} `json:"response"`
 }
 
+type GetServerInfoResponse struct {
+	ServerTime int64 `json:"servertime"`
+}
+
 type Player struct {
 	SteamID     string `json:"steamid"`
 	AvatarFull  string `json:"avatarfull"`
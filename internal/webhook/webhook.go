@@ -0,0 +1,321 @@
+// Package webhook notifies the webhook subscriptions when a user changes their
+// avatar or frame. Events are JSON signed with the secret of the webhook and
+// retried with exponential backoff. Retries are kept in memory, so the ones
+// pending when the server stops are given up.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/mrmarble/steam-avatars/internal/download"
+	"github.com/mrmarble/steam-avatars/internal/tracing"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Headers of the deliveries. The signature is the hex HMAC-SHA256 of the
+// timestamp, a dot and the body, so a captured delivery can't be replayed
+// later with a new timestamp.
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// EventUserChanged is sent when a subscribed user changes their avatar or
+// frame.
+const EventUserChanged = "user.changed"
+
+// ErrInvalidURL is returned for callback URLs that can't be delivered to.
+var ErrInvalidURL = errors.New("webhook URL must be an absolute https URL")
+
+// ValidateURL checks that a callback URL can be delivered to. Whether its host
+// is a public address is only known when delivering.
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return ErrInvalidURL
+	}
+
+	return nil
+}
+
+// Event is the payload of a delivery.
+type Event struct {
+	ID        string    `json:"id"` // Same across retries
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	SteamID   string    `json:"steam_id"`
+	Before    Images    `json:"before"`
+	After     Images    `json:"after"`
+}
+
+// Images are the avatar and frame a user has equipped.
+type Images struct {
+	Avatar Item  `json:"avatar"`
+	Frame  *Item `json:"frame"` // Nil without a frame
+}
+
+// Item is an equipped avatar or frame. Items are empty for the avatars picked
+// from the default ones.
+type Item struct {
+	ItemID string `json:"item_id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Hash   string `json:"hash"` // SHA-256 of the image
+	URL    string `json:"url,omitempty"`
+}
+
+// Notifier delivers the events of the users that change to their subscribed
+// webhooks.
+type Notifier struct {
+	logger       zerolog.Logger
+	db           *database.Database
+	client       *http.Client
+	attempts     int
+	backoff      time.Duration
+	disableAfter int
+
+	stopped    context.Context // Done once shut down, ending the backoffs
+	stop       context.CancelFunc
+	mu         sync.Mutex // Guards closed and adding to deliveries
+	closed     bool
+	deliveries sync.WaitGroup
+}
+
+func New(logger zerolog.Logger, db *database.Database, config config.WebhooksConfig) *Notifier {
+	transport := &http.Transport{
+		Proxy:                 nil, // A proxy would resolve the hosts instead of the dialer
+		DialContext:           download.NewDialer().DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: config.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	stopped, stop := context.WithCancel(context.Background())
+
+	return &Notifier{
+		logger: logger,
+		db:     db,
+		client: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: otelhttp.NewTransport(transport),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		attempts:     config.Attempts,
+		backoff:      config.Backoff,
+		disableAfter: config.DisableAfter,
+		stopped:      stopped,
+		stop:         stop,
+	}
+}
+
+// Notify is a database.UserChangeFunc sending an event to the webhooks
+// subscribed to the user. Deliveries run in the background, and changes after
+// Shutdown are dropped.
+func (n *Notifier) Notify(ctx context.Context, before, after *database.User) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	n.deliveries.Add(1)
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer n.deliveries.Done()
+
+		hooks, err := n.db.Subscribers(ctx, after.ID)
+		if err != nil {
+			n.logger.Error().Err(err).Int64("steam_id", after.ID).Msg("failed to get webhook subscribers")
+			return
+		}
+		if len(hooks) == 0 {
+			return
+		}
+
+		event := Event{
+			ID:        newID(),
+			Type:      EventUserChanged,
+			Timestamp: time.Now().UTC(),
+			SteamID:   strconv.FormatInt(after.ID, 10),
+			Before:    images(before),
+			After:     images(after),
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			n.logger.Error().Err(err).Msg("failed to encode webhook event")
+			return
+		}
+
+		n.deliveries.Add(len(hooks))
+		for _, hook := range hooks {
+			go func() {
+				defer n.deliveries.Done()
+				n.deliver(ctx, hook, event, body)
+			}()
+		}
+	}()
+}
+
+// Shutdown gives up the pending retries and waits for the deliveries in flight
+// to finish and be recorded, or for ctx to be done.
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	n.closed = true
+	n.mu.Unlock()
+	n.stop()
+
+	done := make(chan struct{})
+	go func() {
+		n.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver sends an event to a webhook until it's accepted, it's rejected with
+// a client error, the attempts run out or the notifier is shut down, then
+// records and logs the outcome.
+func (n *Notifier) deliver(ctx context.Context, hook *database.Webhook, event Event, body []byte) {
+	steamID, _ := strconv.ParseInt(event.SteamID, 10, 64)
+	delivery := &database.WebhookDelivery{ID: event.ID, Timestamp: event.Timestamp, SteamID: steamID}
+
+	backoff := n.backoff
+	for delivery.Attempts < n.attempts {
+		if delivery.Attempts > 0 {
+			if !n.wait(backoff) {
+				break
+			}
+			backoff *= 2
+		}
+		delivery.Attempts++
+
+		status, err := n.send(ctx, hook, event, body)
+		delivery.StatusCode = status
+		if err == nil {
+			delivery.Success, delivery.Error = true, ""
+			break
+		}
+		delivery.Error = err.Error()
+		if !retryable(status) || errors.Is(err, download.ErrBlockedAddress) {
+			break
+		}
+	}
+
+	logger := n.logger.With().Str("webhook", hook.ID).Str("delivery", event.ID).Logger()
+	disabled, err := n.db.RecordDelivery(ctx, hook.ID, delivery, n.disableAfter)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to record webhook delivery")
+	}
+	if disabled {
+		logger.Warn().Msg("disabled webhook after too many failed deliveries")
+	}
+	if !delivery.Success {
+		logger.Warn().Str("error", delivery.Error).Int("attempts", delivery.Attempts).Msg("failed to deliver webhook")
+	}
+}
+
+// wait sleeps for d, and reports false if the notifier was shut down first.
+func (n *Notifier) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-n.stopped.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// send makes one delivery attempt and returns the status code of the
+// response, zero if there was none.
+func (n *Notifier) send(ctx context.Context, hook *database.Webhook, event Event, body []byte) (status int, err error) {
+	ctx, span := tracing.Start(ctx, "webhook.send", attribute.String("webhook.id", hook.ID))
+	defer func() { tracing.End(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "steam-avatars")
+	req.Header.Set(HeaderEvent, event.Type)
+	req.Header.Set(HeaderDelivery, event.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(hook.Secret, timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of a delivery, as sent in the signature
+// header.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryable reports whether a failed attempt may succeed later: network
+// errors, timeouts, rate limits and server errors.
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+func images(user *database.User) Images {
+	images := Images{Avatar: Item{ItemID: user.AvatarItemID, Name: user.AvatarName, Hash: user.AvatarHash, URL: user.AvatarURL}}
+	if user.FrameHash != "" {
+		images.Frame = &Item{ItemID: user.FrameItemID, Name: user.FrameName, Hash: user.FrameHash, URL: user.FrameURL}
+	}
+
+	return images
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
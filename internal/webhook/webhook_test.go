@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mrmarble/steam-avatars/internal/config"
+	"github.com/mrmarble/steam-avatars/internal/database"
+	"github.com/rs/zerolog"
+	"github.com/valkey-io/valkey-go"
+)
+
+const steamID = 76561197960287930
+
+// newTestNotifier returns a notifier delivering to handler, which is called
+// with the number of the attempt, and the webhook subscribed to steamID.
+func newTestNotifier(t *testing.T, backoff time.Duration, handler func(attempt int, w http.ResponseWriter, r *http.Request)) (*Notifier, *database.Database, *database.Webhook) {
+	t.Helper()
+
+	client, err := valkey.NewClient(valkey.ClientOption{
+		InitAddress:       []string{miniredis.RunT(t).Addr()},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	db := database.New(client, "test:")
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(int(attempts.Add(1)), w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	hook := &database.Webhook{TokenID: "token", URL: server.URL, SteamIDs: []int64{steamID}}
+	if err := db.CreateWebhook(context.Background(), hook); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(zerolog.Nop(), db, config.WebhooksConfig{Attempts: 3, Backoff: backoff, Timeout: time.Second, DisableAfter: 10})
+	n.client = server.Client() // The dialer refuses the loopback address of the server
+
+	return n, db, hook
+}
+
+func deliveries(t *testing.T, db *database.Database, hook *database.Webhook) []*database.WebhookDelivery {
+	t.Helper()
+
+	deliveries, err := db.GetDeliveries(context.Background(), hook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return deliveries
+}
+
+func TestNotifyRetries(t *testing.T) {
+	var secret string
+	n, db, hook := newTestNotifier(t, time.Millisecond, func(attempt int, w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(HeaderSignature), "sha256="+Sign(secret, r.Header.Get(HeaderTimestamp), body); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		if got := r.Header.Get(HeaderEvent); got != EventUserChanged {
+			t.Errorf("event = %q, want %q", got, EventUserChanged)
+		}
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	secret = hook.Secret
+
+	n.Notify(context.Background(), &database.User{ID: steamID, AvatarHash: "a"}, &database.User{ID: steamID, AvatarHash: "b"})
+	n.deliveries.Wait()
+
+	got := deliveries(t, db, hook)
+	if len(got) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(got))
+	}
+	if !got[0].Success || got[0].Attempts != 2 || got[0].StatusCode != http.StatusOK {
+		t.Errorf("delivery = %+v, want a success on the second attempt", got[0])
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	attempted := make(chan struct{}, 1)
+	n, db, hook := newTestNotifier(t, time.Hour, func(_ int, w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		attempted <- struct{}{}
+	})
+
+	n.Notify(context.Background(), &database.User{ID: steamID, AvatarHash: "a"}, &database.User{ID: steamID, AvatarHash: "b"})
+	<-attempted
+
+	// The delivery is waiting an hour to retry.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v, want the backoff given up", err)
+	}
+
+	got := deliveries(t, db, hook)
+	if len(got) != 1 {
+		t.Fatalf("got %d deliveries, want the pending one recorded", len(got))
+	}
+	if got[0].Success || got[0].Attempts != 1 || got[0].StatusCode != http.StatusInternalServerError {
+		t.Errorf("delivery = %+v, want the failed first attempt", got[0])
+	}
+
+	n.Notify(context.Background(), &database.User{ID: steamID, AvatarHash: "b"}, &database.User{ID: steamID, AvatarHash: "c"})
+	n.deliveries.Wait()
+	if got := deliveries(t, db, hook); len(got) != 1 {
+		t.Errorf("got %d deliveries, want none after Shutdown", len(got)-1)
+	}
+}